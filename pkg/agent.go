@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/reubenmiller/go-c8y/pkg/c8y"
+	"github.com/reubenmiller/go-c8y/pkg/certutil"
+)
+
+type CmdGroupAgent struct {
+	C8yHost         string        `long:"cumulocity-host" description:"Provide platform endpoint, e.g. 'https://iot.eu-latest.cumulocity.com'" required:"true"`
+	CertificateFile string        `long:"certificate" description:"File path to your certificate, replaced after each renewal" required:"true"`
+	PrivateKeyFile  string        `long:"private-key" description:"File path to your private key, replaced when the operation requests a key rotation" required:"true"`
+	IdentityType    string        `long:"identity-type" description:"Type of the external ID the device managed object is looked up with first" default:"c8y_Serial"`
+	PollInterval    time.Duration `long:"poll-interval" description:"Interval for polling pending operations" default:"30s"`
+	Once            bool          `long:"once" description:"Process pending operations once and exit"`
+	PublishInfo     bool          `long:"publish-certificate-info" description:"After each renewal update the c8y_CertificateInfo fragment of the device managed object and create a c8y_CertificateRenewed event"`
+}
+
+var agentCmdName = "agent"
+var agentCmdGroup CmdGroupAgent
+
+// Operation requesting a certificate renewal, created by the platform for the device, e.g.
+// {"deviceId": "<id>", "description": "Renew certificate", "c8y_RenewCertificate": {"rotateKey": true}}
+const renewCertificateOperation = "c8y_RenewCertificate"
+
+// agentTokenRefreshBefore is the minimal validity of the access token before an operation is processed
+const agentTokenRefreshBefore = 5 * time.Minute
+
+type renewCertificateOperationRequest struct {
+	ID               string `json:"id"`
+	RenewCertificate struct {
+		RotateKey bool `json:"rotateKey"`
+	} `json:"c8y_RenewCertificate"`
+}
+
+// certificateAgent holds the current certificate of the device and the access token obtained with it
+type certificateAgent struct {
+	*CmdGroupAgent
+	clientCert      tls.Certificate
+	token           *cachedToken
+	client          *c8y.Client
+	managedObjectID string
+}
+
+func (g *CmdGroupAgent) Execute(args []string) error {
+	slog.Info(fmt.Sprintf("Started %s with arguments: C8yHost=%s CertFile=%s PrivKeyFile=%s IdentityType=%s PollInterval=%s Once=%t PublishInfo=%t",
+		agentCmdName, g.C8yHost, g.CertificateFile, g.PrivateKeyFile, g.IdentityType, g.PollInterval, g.Once, g.PublishInfo))
+
+	agent := &certificateAgent{CmdGroupAgent: g, clientCert: readClientCertificateOrExit(g.CertificateFile, g.PrivateKeyFile)}
+	client, err := agent.deviceClient()
+	if err != nil {
+		slog.Error("Error while requesting access token. Exiting now.", "error", err)
+		os.Exit(exitCodeGeneralProcessingError)
+	}
+	cn := agent.clientCert.Leaf.Subject.CommonName
+	mo, err := findDeviceManagedObject(client, g.IdentityType, cn, deviceUserPrefix+cn)
+	if err != nil {
+		slog.Error("Error while looking up the device managed object. Exiting now.", "error", err)
+		os.Exit(exitCodeGeneralProcessingError)
+	}
+	if mo == nil {
+		slog.Error("Managed object of the device not found. Operations can only be received by an existing device. Exiting now.", "commonName", cn)
+		os.Exit(exitCodePrerequisitesNotFulfilled)
+	}
+	agent.managedObjectID = mo.ID
+	if err := addSupportedOperation(client, mo.ID, renewCertificateOperation); err != nil {
+		slog.Error("Error while adding supported operation to the device managed object. Exiting now.", "error", err, "managedObjectId", mo.ID)
+		os.Exit(exitCodeGeneralProcessingError)
+	}
+	if err := agent.failInterruptedOperations(client); err != nil {
+		slog.Error("Error while failing interrupted operations. Exiting now.", "error", err, "managedObjectId", mo.ID)
+		os.Exit(exitCodeGeneralProcessingError)
+	}
+	slog.Info("Waiting for operations", "managedObjectId", mo.ID, "operation", renewCertificateOperation)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	for {
+		failed, err := agent.processPendingOperations()
+		if err != nil {
+			if g.Once {
+				slog.Error("Error while processing operations. Exiting now.", "error", err)
+				os.Exit(exitCodeGeneralProcessingError)
+			}
+			slog.Error("Error while processing operations. Retrying.", "error", err, "retryIn", g.PollInterval)
+		}
+		if g.Once {
+			if failed > 0 {
+				slog.Error("Not all operations succeeded. Exiting now.", "failed", failed)
+				os.Exit(exitCodeGeneralProcessingError)
+			}
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			slog.Info("Stopped agent")
+			return nil
+		case <-time.After(g.PollInterval):
+		}
+	}
+}
+
+// deviceClient returns a client authenticated with an access token of the current certificate, the token is
+// requested again shortly before it expires
+func (a *certificateAgent) deviceClient() (*c8y.Client, error) {
+	// a token without known expiry time is requested again for each use
+	if expiresAt, ok := a.tokenExpiresAt(); !ok || time.Until(expiresAt) < agentTokenRefreshBefore {
+		token, _, err := obtainAccessToken(a.C8yHost, &a.clientCert, nil, 0)
+		if err != nil {
+			return nil, err
+		}
+		a.token = token
+		a.client = newDeviceClient(a.C8yHost, token.AccessToken)
+	}
+	return a.client, nil
+}
+
+// listOperations returns all c8y_RenewCertificate operations of the device with the given status. The platform
+// returns the oldest first. All pages are read before the caller changes the status of any operation, as that would
+// shift the following pages.
+func (a *certificateAgent) listOperations(client *c8y.Client, status string) ([]renewCertificateOperationRequest, error) {
+	operations := []renewCertificateOperationRequest{}
+	for page := 1; ; page++ {
+		collection := struct {
+			Operations []renewCertificateOperationRequest `json:"operations"`
+		}{}
+		_, err := client.SendRequest(context.TODO(), c8y.RequestOptions{
+			Method: http.MethodGet,
+			Path:   "devicecontrol/operations",
+			Query: url.Values{"deviceId": {a.managedObjectID}, "status": {status}, "fragmentType": {renewCertificateOperation},
+				"pageSize": {"100"}, "currentPage": {strconv.Itoa(page)}}.Encode(),
+			ResponseData: &collection,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error while retrieving %s operations: %w", status, err)
+		}
+		if len(collection.Operations) == 0 {
+			return operations, nil
+		}
+		operations = append(operations, collection.Operations...)
+	}
+}
+
+// failInterruptedOperations fails operations left in EXECUTING by a previous run which was stopped before it could
+// report the result
+func (a *certificateAgent) failInterruptedOperations(client *c8y.Client) error {
+	operations, err := a.listOperations(client, c8y.OperationStatusExecuting)
+	if err != nil {
+		return err
+	}
+	for _, operation := range operations {
+		_, _, err := client.Operation.Update(context.TODO(), operation.ID, &c8y.OperationUpdateOptions{
+			Status:        c8y.OperationStatusFailed,
+			FailureReason: "Agent restarted during execution",
+		})
+		if err != nil {
+			return fmt.Errorf("error while failing operation %s: %w", operation.ID, err)
+		}
+		slog.Warn("Failed operation interrupted by a restart of the agent", "id", operation.ID)
+	}
+	return nil
+}
+
+func (a *certificateAgent) tokenExpiresAt() (time.Time, bool) {
+	if a.token == nil {
+		return time.Time{}, false
+	}
+	return a.token.expiresAt()
+}
+
+// processPendingOperations executes the pending operations and returns the number of operations which didn't
+// succeed
+func (a *certificateAgent) processPendingOperations() (int, error) {
+	client, err := a.deviceClient()
+	if err != nil {
+		return 0, fmt.Errorf("error while requesting access token: %w", err)
+	}
+	operations, err := a.listOperations(client, c8y.OperationStatusPending)
+	if err != nil {
+		return 0, err
+	}
+	failed := 0
+	// operations are executed in the order they were created
+	for _, operation := range operations {
+		if !a.executeOperation(client, operation) {
+			failed++
+		}
+	}
+	return failed, nil
+}
+
+// executeOperation renews the certificate and reports the result as operation status. The status is updated with
+// the client of the previous certificate, its access token stays valid after the renewal. Returns true if the
+// operation succeeded.
+func (a *certificateAgent) executeOperation(client *c8y.Client, operation renewCertificateOperationRequest) bool {
+	slog.Info("Executing operation", "id", operation.ID, "rotateKey", operation.RenewCertificate.RotateKey)
+	if _, _, err := client.Operation.Update(context.TODO(), operation.ID, &c8y.OperationUpdateOptions{Status: c8y.OperationStatusExecuting}); err != nil {
+		slog.Error("Error while setting operation to EXECUTING. Skipping it.", "error", err, "id", operation.ID)
+		return false
+	}
+
+	update := &c8y.OperationUpdateOptions{Status: c8y.OperationStatusSuccessful}
+	newCert, err := a.renewCertificate(client, operation.RenewCertificate.RotateKey)
+	if err != nil {
+		slog.Error("Error while renewing certificate", "error", err, "id", operation.ID)
+		update = &c8y.OperationUpdateOptions{Status: c8y.OperationStatusFailed, FailureReason: err.Error()}
+	}
+	if _, _, err := client.Operation.Update(context.TODO(), operation.ID, update); err != nil {
+		slog.Error("Error while updating operation", "error", err, "id", operation.ID, "status", update.Status)
+		return false
+	}
+	slog.Info("Finished operation", "id", operation.ID, "status", update.Status)
+
+	if newCert != nil && a.PublishInfo {
+		if err := publishCertificateInfo(client, a.managedObjectID, newCert.Leaf); err != nil {
+			slog.Warn("Error while publishing certificate info to the platform", "error", err, "managedObjectId", a.managedObjectID)
+		}
+	}
+	return newCert != nil
+}
+
+// renewCertificate re-enrolls the current certificate, optionally with a new private key, and verifies the new
+// certificate by requesting an access token with it. Only a verified certificate replaces the files.
+func (a *certificateAgent) renewCertificate(client *c8y.Client, rotateKey bool) (*tls.Certificate, error) {
+	previousKeyPEM, err := readFromFile(a.PrivateKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("error while reading private key: %w", err)
+	}
+	keyPEM := previousKeyPEM
+	if rotateKey {
+		if keyPEM, err = certutil.MakeEllipticPrivateKeyPEM(); err != nil {
+			return nil, fmt.Errorf("error while generating private key: %w", err)
+		}
+	}
+	key, err := certutil.ParsePrivateKeyPEM(keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("error while parsing private key: %w", err)
+	}
+	newCert, err := reEnrollCertificate(client, a.token.AccessToken, a.clientCert.Leaf.Subject.CommonName, key)
+	if err != nil {
+		return nil, err
+	}
+	certPEM := certutil.MarshalCertificateToPEM(newCert.Raw)
+	clientCert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("error while processing renewed certificate: %w", err)
+	}
+	token, _, err := obtainAccessToken(a.C8yHost, &clientCert, nil, 0)
+	if err != nil {
+		return nil, errors.Join(errors.New("renewed certificate is not accepted by the platform"), err)
+	}
+
+	if err := a.replaceCertificateFiles(certPEM, keyPEM, previousKeyPEM); err != nil {
+		return nil, err
+	}
+	slog.Info("Replaced certificate", "fileName", a.CertificateFile, "serialNumber", serialToHex(newCert.SerialNumber),
+		"notAfter", newCert.NotAfter.Format(time.RFC3339), "rotatedKey", rotateKey)
+	a.clientCert, a.token, a.client = clientCert, token, newDeviceClient(a.C8yHost, token.AccessToken)
+	return &clientCert, nil
+}
+
+// replaceCertificateFiles writes private key and certificate as a pair, so key and certificate on disk always
+// match. Both writes are atomic: a failed write leaves the file unchanged, only an already replaced key is restored.
+func (a *certificateAgent) replaceCertificateFiles(certPEM []byte, keyPEM []byte, previousKeyPEM []byte) error {
+	rotatedKey := !bytes.Equal(keyPEM, previousKeyPEM)
+	if rotatedKey {
+		if err := writeFileAtomically(keyPEM, a.PrivateKeyFile, 0600); err != nil {
+			return fmt.Errorf("error while writing private key: %w", err)
+		}
+	}
+	if err := writeFileAtomically(certPEM, a.CertificateFile, 0644); err != nil {
+		err = fmt.Errorf("error while writing certificate: %w", err)
+		if !rotatedKey {
+			return err
+		}
+		if restoreErr := writeFileAtomically(previousKeyPEM, a.PrivateKeyFile, 0600); restoreErr != nil {
+			err = errors.Join(err, fmt.Errorf("error while restoring private key, key and certificate don't match: %w", restoreErr))
+		}
+		return err
+	}
+	return nil
+}
+
+// addSupportedOperation adds the operation to the c8y_SupportedOperations of the managed object, so the platform
+// offers it for the device
+func addSupportedOperation(client *c8y.Client, managedObjectID string, operation string) error {
+	mo := struct {
+		SupportedOperations []string `json:"c8y_SupportedOperations"`
+	}{}
+	_, err := client.SendRequest(context.TODO(), c8y.RequestOptions{
+		Method:       http.MethodGet,
+		Path:         "inventory/managedObjects/" + managedObjectID,
+		ResponseData: &mo,
+	})
+	if err != nil {
+		return err
+	}
+	if slices.Contains(mo.SupportedOperations, operation) {
+		return nil
+	}
+	_, _, err = client.Inventory.Update(context.TODO(), managedObjectID, map[string]any{
+		"c8y_SupportedOperations": append(mo.SupportedOperations, operation),
+	})
+	return err
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/reubenmiller/go-c8y/pkg/c8y"
+)
+
+func TestAgentOperationLifecycle(t *testing.T) {
+	type operation struct {
+		status      string
+		rotateKey   bool
+		otherDevice bool
+		wantStatus  string
+	}
+	repeat := func(count int, op operation) []operation {
+		operations := make([]operation, count)
+		for i := range operations {
+			operations[i] = op
+		}
+		return operations
+	}
+	tests := []struct {
+		name            string
+		operations      []operation
+		removeKey       bool
+		wantFailed      int
+		wantCertChanged bool
+		wantKeyChanged  bool
+	}{
+		{"pending operations succeed", []operation{
+			{status: c8y.OperationStatusPending, wantStatus: c8y.OperationStatusSuccessful},
+			{status: c8y.OperationStatusPending, wantStatus: c8y.OperationStatusSuccessful},
+		}, false, 0, true, false},
+		{"key rotation", []operation{
+			{status: c8y.OperationStatusPending, rotateKey: true, wantStatus: c8y.OperationStatusSuccessful},
+		}, false, 0, true, true},
+		{"missing private key fails the operation", []operation{
+			{status: c8y.OperationStatusPending, wantStatus: c8y.OperationStatusFailed},
+		}, true, 1, false, false},
+		{"operations of other devices are ignored", []operation{
+			{status: c8y.OperationStatusPending, otherDevice: true, wantStatus: c8y.OperationStatusPending},
+		}, false, 0, false, false},
+		{"interrupted operations of all pages are failed", repeat(150, operation{
+			status: c8y.OperationStatusExecuting, wantStatus: c8y.OperationStatusFailed,
+		}), false, 0, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			platform := startTestPlatform(t)
+			certFile, keyFile, clientCert := platform.writeDeviceCertificate(t, t.TempDir(), "agent-device")
+			certPEM, keyPEM := readTestFile(t, certFile), readTestFile(t, keyFile)
+			agent := &certificateAgent{
+				CmdGroupAgent: &CmdGroupAgent{C8yHost: platform.host, CertificateFile: certFile, PrivateKeyFile: keyFile, IdentityType: deviceIdentityType},
+				clientCert:    clientCert,
+			}
+			// the first access token of the device creates its managed object
+			client, err := agent.deviceClient()
+			if err != nil {
+				t.Fatalf("deviceClient() error = %v", err)
+			}
+
+			platform.mu.Lock()
+			agent.managedObjectID = platform.identities[deviceIdentityType+"/agent-device"]
+			otherDeviceID := platform.createManagedObject(map[string]any{"name": "other-device", "c8y_IsDevice": map[string]any{}})
+			ids := make([]string, len(tt.operations))
+			for i, op := range tt.operations {
+				platform.nextID++
+				ids[i] = strconv.FormatInt(platform.nextID, 10)
+				deviceID := agent.managedObjectID
+				if op.otherDevice {
+					deviceID = otherDeviceID
+				}
+				platform.operations[ids[i]] = map[string]any{
+					"id":                      ids[i],
+					"deviceId":                deviceID,
+					"status":                  op.status,
+					renewCertificateOperation: map[string]any{"rotateKey": op.rotateKey},
+				}
+			}
+			platform.mu.Unlock()
+			if tt.removeKey {
+				if err := os.Remove(keyFile); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := agent.failInterruptedOperations(client); err != nil {
+				t.Fatalf("failInterruptedOperations() error = %v", err)
+			}
+			failed, err := agent.processPendingOperations()
+			if err != nil {
+				t.Fatalf("processPendingOperations() error = %v", err)
+			}
+			if failed != tt.wantFailed {
+				t.Errorf("failed operations = %d, want %d", failed, tt.wantFailed)
+			}
+
+			platform.mu.Lock()
+			for i, op := range tt.operations {
+				got := platform.operations[ids[i]]
+				if got["status"] != op.wantStatus {
+					t.Errorf("operation %s: status = %v, want %s", ids[i], got["status"], op.wantStatus)
+				}
+				if _, hasReason := got["failureReason"]; hasReason != (op.wantStatus == c8y.OperationStatusFailed) {
+					t.Errorf("operation %s: failureReason = %v", ids[i], got["failureReason"])
+				}
+			}
+			platform.mu.Unlock()
+			if changed := !bytes.Equal(readTestFile(t, certFile), certPEM); changed != tt.wantCertChanged {
+				t.Errorf("certificate changed = %t, want %t", changed, tt.wantCertChanged)
+			}
+			if !tt.removeKey {
+				if changed := !bytes.Equal(readTestFile(t, keyFile), keyPEM); changed != tt.wantKeyChanged {
+					t.Errorf("private key changed = %t, want %t", changed, tt.wantKeyChanged)
+				}
+			}
+		})
+	}
+}
+
+func readTestFile(t *testing.T, fileName string) []byte {
+	t.Helper()
+	content, err := os.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return content
+}
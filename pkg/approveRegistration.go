@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+
+	"github.com/reubenmiller/go-c8y/pkg/c8y"
+)
+
+type CmdGroupApproveRegistration struct {
+	C8yHost     string   `long:"cumulocity-host" description:"Provide platform endpoint, e.g. 'https://iot.eu-latest.cumulocity.com'" required:"true"`
+	C8yTenantId string   `long:"cumulocity-tenant-id" description:"Provide platform tenand id, e.g. 't4009123'. Optional (resolved from host when missing)" required:"false"`
+	C8yUser     string   `long:"cumulocity-user" description:"Provide your platform user, e.g. 'john.doe@example.org'" required:"true"`
+	C8yPassword string   `long:"cumulocity-password" description:"Provide your platform users password, e.g. 'aVerySecretPass1337'" required:"true"`
+	DeviceId    string   `long:"device-id" description:"Create (and accept) the registration request for this device, e.g. 'kobu-edge-01'"`
+	Otp         string   `long:"one-time-password" description:"One time password the device is polling with (see registerUsingPoller)"`
+	List        bool     `long:"list" description:"List all registration requests which are not accepted yet"`
+	Approve     []string `long:"approve" description:"Accept the pending registration request of this device id. Can be provided multiple times"`
+	ApproveAll  bool     `long:"approve-all" description:"Accept all registration requests in status PENDING_ACCEPTANCE"`
+}
+
+var approveRegistrationCmdName = "approveRegistration"
+var approveRegistrationCmdGroup CmdGroupApproveRegistration
+
+func (g *CmdGroupApproveRegistration) Execute(args []string) error {
+	slog.Info(fmt.Sprintf("Started %s with arguments: C8yHost=%s C8yTenantId=%s C8yUser=%s C8yPassword=%s DeviceId=%s List=%t Approve=%v ApproveAll=%t",
+		approveRegistrationCmdName, g.C8yHost, g.C8yTenantId, g.C8yUser, "{obfuscated}", g.DeviceId, g.List, g.Approve, g.ApproveAll))
+
+	if len(g.DeviceId) == 0 && !g.List && len(g.Approve) == 0 && !g.ApproveAll {
+		slog.Error("Nothing to do. Provide --device-id, --list, --approve or --approve-all. Exiting now.")
+		os.Exit(exitCodeGeneralProcessingError)
+	}
+	redactSecret(g.Otp)
+
+	tenantID := resolveTenantIDOrExit(g.C8yHost, g.C8yTenantId, g.C8yUser, g.C8yPassword)
+	client := newC8yClient(g.C8yHost, tenantID, g.C8yUser, g.C8yPassword)
+
+	slog.Info("Testing user for having the required permissions")
+	if e := checkForRequiredRoles(client, "ROLE_DEVICE_CONTROL_ADMIN"); e != nil {
+		slog.Error("Error while checking User permissions. Exiting now.", "error", e)
+		os.Exit(exitCodePrerequisitesNotFulfilled)
+	}
+
+	failed := false
+	if len(g.DeviceId) > 0 {
+		if e := createRegistrationRequest(client, g.DeviceId, g.Otp); e != nil {
+			slog.Error("Error while creating registration request", "error", e, "deviceID", g.DeviceId)
+			failed = true
+		}
+	}
+
+	approve := g.Approve
+	if g.List || g.ApproveAll {
+		requests, e := getRegistrationRequests(client)
+		if e != nil {
+			slog.Error("Error while retrieving registration requests. Exiting now.", "error", e)
+			os.Exit(exitCodeGeneralProcessingError)
+		}
+		if g.List {
+			fmt.Printf("%-36s %-24s %-24s %s\n", "DEVICE ID", "STATUS", "OWNER", "CREATED")
+			for _, r := range requests {
+				if r.Status != c8y.NewDeviceRequestAccepted {
+					fmt.Printf("%-36s %-24s %-24s %s\n", r.ID, r.Status, r.Owner, r.CreationTime)
+				}
+			}
+		}
+		if g.ApproveAll {
+			for _, r := range requests {
+				if r.Status == c8y.NewDeviceRequestPendingAcceptance {
+					approve = append(approve, r.ID)
+				}
+			}
+		}
+	}
+
+	for _, deviceID := range approve {
+		if e := acceptRegistrationRequest(client, deviceID); e != nil {
+			slog.Error("Error while accepting registration request", "error", e, "deviceID", deviceID)
+			failed = true
+		}
+	}
+
+	if failed {
+		os.Exit(exitCodeGeneralProcessingError)
+	}
+	return nil
+}
+
+// Creates the registration request a polling device is waiting for. An existing request for the device is left as
+// is if no one-time password is given. Otherwise it is re-created, as the platform doesn't expose the one-time
+// password of an existing request and the device polls with the given one. If the platform requires an acceptance
+// (device connected already), the request is accepted.
+func createRegistrationRequest(client *c8y.Client, deviceID string, otp string) error {
+	request, resp, err := postRegistrationRequest(client, deviceID, otp)
+	if responseStatusCode(resp) == http.StatusConflict && len(otp) > 0 {
+		slog.Info("Registration request exists already. Re-creating it with the given one-time password.", "deviceID", deviceID)
+		if err = deleteRegistrationRequest(client, deviceID); err != nil {
+			return err
+		}
+		request, resp, err = postRegistrationRequest(client, deviceID, otp)
+	}
+	switch {
+	case responseStatusCode(resp) == http.StatusConflict:
+		slog.Info("Registration request exists already", "deviceID", deviceID)
+		if request, _, err = client.DeviceCredentials.GetNewDeviceRequest(context.TODO(), deviceID); err != nil {
+			return err
+		}
+	case err != nil:
+		return err
+	default:
+		slog.Info("Created registration request", "deviceID", deviceID, "status", request.Status)
+	}
+
+	if request.Status == c8y.NewDeviceRequestPendingAcceptance {
+		return acceptRegistrationRequest(client, deviceID)
+	}
+	return nil
+}
+
+func postRegistrationRequest(client *c8y.Client, deviceID string, otp string) (*c8y.NewDeviceRequest, *c8y.Response, error) {
+	body := map[string]string{"id": deviceID}
+	if len(otp) > 0 {
+		body["enrollmentToken"] = otp
+	}
+	request := new(c8y.NewDeviceRequest)
+	// the request body contains the one-time password, so it must not be logged
+	resp, err := client.SendRequest(c8y.NewSilentLoggerContext(context.TODO()), c8y.RequestOptions{
+		Method:       "POST",
+		Path:         "devicecontrol/newDeviceRequests",
+		Body:         body,
+		ResponseData: request,
+	})
+	return request, resp, err
+}
+
+// Sets the status of a registration request to ACCEPTED. Only requests in PENDING_ACCEPTANCE can be accepted.
+func acceptRegistrationRequest(client *c8y.Client, deviceID string) error {
+	request, _, err := client.DeviceCredentials.GetNewDeviceRequest(context.TODO(), deviceID)
+	if err != nil {
+		return err
+	}
+	switch request.Status {
+	case c8y.NewDeviceRequestAccepted:
+		slog.Info("Registration request is accepted already", "deviceID", deviceID)
+		return nil
+	case c8y.NewDeviceRequestWaitingForConnection:
+		return errors.New("Device did not connect yet (status " + request.Status + "). Can't accept registration request.")
+	}
+	if _, _, err = client.DeviceCredentials.Update(context.TODO(), deviceID, c8y.NewDeviceRequestAccepted); err != nil {
+		return err
+	}
+	slog.Info("Accepted registration request", "deviceID", deviceID)
+	return nil
+}
+
+// Returns all registration requests of the tenant
+func getRegistrationRequests(client *c8y.Client) ([]c8y.NewDeviceRequest, error) {
+	requests := []c8y.NewDeviceRequest{}
+	for page := 1; ; page++ {
+		currentPage := page
+		collection, _, err := client.DeviceCredentials.GetNewDeviceRequests(context.TODO(), &c8y.NewDeviceRequestOptions{
+			PaginationOptions: c8y.PaginationOptions{PageSize: 100, CurrentPage: &currentPage},
+		})
+		if err != nil {
+			return nil, err
+		}
+		requests = append(requests, collection.NewDeviceRequests...)
+		if len(collection.NewDeviceRequests) < 100 {
+			return requests, nil
+		}
+	}
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// A cassette holds the HTTP exchanges of a run. In record mode all requests are forwarded and the
+// (redacted) exchanges are written to file after each request, so that the cassette is complete even
+// when a command exits early. In replay mode no network is used and recorded responses are served back.
+type cassette struct {
+	mu       sync.Mutex
+	fileName string
+	replay   bool
+	secrets  []string
+
+	Version      int                   `json:"version"`
+	RecordedAt   string                `json:"recordedAt"`
+	Command      []string              `json:"command"`
+	Interactions []cassetteInteraction `json:"interactions"`
+
+	used []bool
+}
+
+type cassetteInteraction struct {
+	Request    cassetteRequest   `json:"request"`
+	Response   *cassetteResponse `json:"response,omitempty"`
+	Error      string            `json:"error,omitempty"`
+	DurationMs int64             `json:"durationMs"`
+}
+
+type cassetteRequest struct {
+	Method       string      `json:"method"`
+	URL          string      `json:"url"`
+	Header       http.Header `json:"header"`
+	Body         string      `json:"body,omitempty"`
+	BodyEncoding string      `json:"bodyEncoding,omitempty"`
+}
+
+type cassetteResponse struct {
+	StatusCode   int         `json:"statusCode"`
+	Status       string      `json:"status"`
+	Header       http.Header `json:"header"`
+	Body         string      `json:"body,omitempty"`
+	BodyEncoding string      `json:"bodyEncoding,omitempty"`
+}
+
+const cassetteVersion = 1
+const redactedValue = "{redacted}"
+
+// httpCassette is the active cassette. It is nil unless --record or --replay is provided.
+var httpCassette *cassette
+
+var sensitiveHeaders = []string{"Authorization", "Cookie", "Set-Cookie", "X-Xsrf-Token"}
+var sensitiveJSONFields = regexp.MustCompile(`("(?i:password|accessToken|token|enrollmentToken|oneTimePassword|otp|securityToken)"\s*:\s*)"[^"]*"`)
+var sensitiveQueryParams = regexp.MustCompile(`((?i:one-time-password|password|otp|token)=)[^&"\s]+`)
+var privateKeyPEM = regexp.MustCompile(`-----BEGIN [A-Z ]*PRIVATE KEY-----[\s\S]*?-----END [A-Z ]*PRIVATE KEY-----`)
+var jwtToken = regexp.MustCompile(`eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+`)
+
+func newRecordingCassette(fileName string) *cassette {
+	return &cassette{
+		fileName:     fileName,
+		Version:      cassetteVersion,
+		RecordedAt:   time.Now().Format(time.RFC3339),
+		Command:      redactArguments(os.Args[1:]),
+		Interactions: []cassetteInteraction{},
+	}
+}
+
+func loadCassette(fileName string) (*cassette, error) {
+	b, err := readFromFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	c := &cassette{fileName: fileName, replay: true}
+	if err := json.Unmarshal(b, c); err != nil {
+		return nil, fmt.Errorf("invalid cassette file %s: %w", fileName, err)
+	}
+	if c.Version != cassetteVersion {
+		return nil, fmt.Errorf("unsupported cassette version %d in %s", c.Version, fileName)
+	}
+	c.used = make([]bool, len(c.Interactions))
+	return c, nil
+}
+
+// redactSecret registers values (passwords, one-time passwords, ...) which must never appear in a recorded cassette
+func redactSecret(values ...string) {
+	if httpCassette == nil {
+		return
+	}
+	httpCassette.mu.Lock()
+	defer httpCassette.mu.Unlock()
+	for _, v := range values {
+		if len(v) > 0 {
+			httpCassette.secrets = append(httpCassette.secrets, v)
+		}
+	}
+}
+
+// attach routes all HTTPS requests of the given transport through the cassette. Recorded requests are sent with
+// a clone of the transport, which doesn't carry the registered protocol and talks to the network. HTTP/2 is
+// disabled before cloning, as setting it up would claim the same hook.
+func (c *cassette) attach(tr *http.Transport) {
+	protocols := &http.Protocols{}
+	protocols.SetHTTP1(true)
+	tr.Protocols = protocols
+	network := tr.Clone()
+	tr.RegisterProtocol("https", &cassetteTripper{cassette: c, transport: network})
+}
+
+// cassetteTripper is registered as alternative https protocol of a transport
+type cassetteTripper struct {
+	cassette  *cassette
+	transport *http.Transport
+}
+
+func (t *cassetteTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.cassette.replay {
+		return t.cassette.replayRequest(req)
+	}
+	return t.cassette.recordRequest(req, t.transport)
+}
+
+func (c *cassette) recordRequest(req *http.Request, tr *http.Transport) (*http.Response, error) {
+	var reqBody []byte
+	forwarded := req.Clone(req.Context())
+	if req.Body != nil {
+		b, err := io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		reqBody = b
+		forwarded.Body = io.NopCloser(bytes.NewReader(reqBody))
+	}
+
+	start := time.Now()
+	resp, err := tr.RoundTrip(forwarded)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	interaction := cassetteInteraction{
+		Request:    c.redactRequest(req, reqBody),
+		DurationMs: time.Since(start).Milliseconds(),
+	}
+	if err != nil {
+		interaction.Error = c.redact(err.Error())
+	} else {
+		respBody, readErr := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if readErr != nil {
+			return nil, readErr
+		}
+		resp.Body = io.NopCloser(bytes.NewReader(respBody))
+		body, encoding := c.encodeBody(respBody)
+		interaction.Response = &cassetteResponse{
+			StatusCode:   resp.StatusCode,
+			Status:       resp.Status,
+			Header:       c.redactHeader(resp.Header),
+			Body:         body,
+			BodyEncoding: encoding,
+		}
+	}
+
+	c.Interactions = append(c.Interactions, interaction)
+	if saveErr := c.save(); saveErr != nil {
+		slog.Warn("Error while writing cassette file", "error", saveErr, "fileName", c.fileName)
+	}
+	return resp, err
+}
+
+// replayRequest serves the first unused interaction with the same method, path and query
+func (c *cassette) replayRequest(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		io.Copy(io.Discard, req.Body)
+		req.Body.Close()
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, interaction := range c.Interactions {
+		if c.used[i] || !matchesRecordedRequest(req, interaction.Request) {
+			continue
+		}
+		c.used[i] = true
+		if interaction.Response == nil {
+			return nil, fmt.Errorf("replayed error: %s", interaction.Error)
+		}
+		body, err := decodeCassetteBody(interaction.Response.Body, interaction.Response.BodyEncoding)
+		if err != nil {
+			return nil, err
+		}
+		resp := &http.Response{
+			StatusCode:    interaction.Response.StatusCode,
+			Status:        interaction.Response.Status,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        interaction.Response.Header.Clone(),
+			Body:          io.NopCloser(bytes.NewReader(body)),
+			ContentLength: int64(len(body)),
+			Request:       req,
+		}
+		if resp.Header == nil {
+			resp.Header = http.Header{}
+		}
+		return resp, nil
+	}
+	return nil, fmt.Errorf("no recorded interaction left for %s %s in cassette %s", req.Method, req.URL.RequestURI(), c.fileName)
+}
+
+func matchesRecordedRequest(req *http.Request, recorded cassetteRequest) bool {
+	if req.Method != recorded.Method {
+		return false
+	}
+	u, err := url.Parse(recorded.URL)
+	if err != nil {
+		return false
+	}
+	// sensitive query values are redacted in the cassette, so only the query keys are compared
+	return u.Path == req.URL.Path && queryKeys(u.Query()) == queryKeys(req.URL.Query())
+}
+
+func queryKeys(values url.Values) string {
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return strings.Join(keys, "&")
+}
+
+func (c *cassette) save() error {
+	b, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeToFile(string(b), c.fileName)
+}
+
+func (c *cassette) redactRequest(req *http.Request, body []byte) cassetteRequest {
+	encoded, encoding := c.encodeBody(body)
+	return cassetteRequest{
+		Method:       req.Method,
+		URL:          c.redact(req.URL.String()),
+		Header:       c.redactHeader(req.Header),
+		Body:         encoded,
+		BodyEncoding: encoding,
+	}
+}
+
+func (c *cassette) redactHeader(header http.Header) http.Header {
+	redacted := http.Header{}
+	for name, values := range header {
+		for _, v := range values {
+			redacted.Add(name, c.redact(v))
+		}
+	}
+	for _, name := range sensitiveHeaders {
+		values := redacted.Values(name)
+		for i, v := range values {
+			// keep the authentication scheme as it is useful for diagnostics
+			if scheme, _, found := strings.Cut(v, " "); found && (scheme == "Basic" || scheme == "Bearer") {
+				values[i] = scheme + " " + redactedValue
+			} else {
+				values[i] = redactedValue
+			}
+		}
+	}
+	return redacted
+}
+
+// encodeBody redacts a body and returns it as string, binary bodies are base64 encoded
+func (c *cassette) encodeBody(body []byte) (string, string) {
+	if len(body) == 0 {
+		return "", ""
+	}
+	if !utf8.Valid(body) {
+		return base64.StdEncoding.EncodeToString(body), "base64"
+	}
+	return c.redact(string(body)), ""
+}
+
+func decodeCassetteBody(body string, encoding string) ([]byte, error) {
+	if encoding == "base64" {
+		return base64.StdEncoding.DecodeString(body)
+	}
+	return []byte(body), nil
+}
+
+func (c *cassette) redact(s string) string {
+	for _, secret := range c.secrets {
+		s = strings.ReplaceAll(s, secret, redactedValue)
+	}
+	s = privateKeyPEM.ReplaceAllString(s, redactedValue)
+	s = jwtToken.ReplaceAllString(s, redactedValue)
+	s = sensitiveJSONFields.ReplaceAllString(s, `${1}"`+redactedValue+`"`)
+	return sensitiveQueryParams.ReplaceAllString(s, "${1}"+redactedValue)
+}
+
+// redactArguments hides the values of password like command line options
+func redactArguments(args []string) []string {
+	redacted := make([]string, len(args))
+	hideNext := false
+	for i, arg := range args {
+		switch {
+		case hideNext:
+			redacted[i] = redactedValue
+			hideNext = false
+		case isSensitiveOption(arg):
+			if name, _, found := strings.Cut(arg, "="); found {
+				redacted[i] = name + "=" + redactedValue
+			} else {
+				redacted[i] = arg
+				hideNext = true
+			}
+		default:
+			redacted[i] = arg
+		}
+	}
+	return redacted
+}
+
+func isSensitiveOption(arg string) bool {
+	name, _, _ := strings.Cut(arg, "=")
+	return strings.HasPrefix(name, "-") && (strings.Contains(name, "password") || strings.Contains(name, "token"))
+}
+
+// activateCassette sets up recording or replaying for the current run
+func activateCassette(recordFile string, replayFile string) error {
+	if len(recordFile) > 0 && len(replayFile) > 0 {
+		return errors.New("--record and --replay can not be used together")
+	}
+	switch {
+	case len(recordFile) > 0:
+		httpCassette = newRecordingCassette(recordFile)
+	case len(replayFile) > 0:
+		c, err := loadCassette(replayFile)
+		if err != nil {
+			return err
+		}
+		httpCassette = c
+	default:
+		return nil
+	}
+	return nil
+}
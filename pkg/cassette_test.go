@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/reubenmiller/go-c8y/pkg/c8y"
+)
+
+// TestCassetteRoundTrip records exchanges with the mock platform and replays them without network
+func TestCassetteRoundTrip(t *testing.T) {
+	platform := startTestPlatform(t)
+	platform.password = "s3cret-Passw0rd"
+	_, _, clientCert := platform.writeDeviceCertificate(t, t.TempDir(), "cassette-device")
+	t.Cleanup(func() { httpCassette = nil })
+
+	exchanges := []struct {
+		name string
+		run  func(client *c8y.Client, clientCert *tls.Certificate) (string, error)
+		// the recorded result is replayed redacted
+		redacted bool
+	}{
+		{"current tenant", func(client *c8y.Client, _ *tls.Certificate) (string, error) {
+			tenant, _, err := client.Tenant.GetCurrentTenant(context.Background())
+			if err != nil {
+				return "", err
+			}
+			return tenant.Name, nil
+		}, false},
+		{"access token", func(client *c8y.Client, clientCert *tls.Certificate) (string, error) {
+			token, err := requestAccessToken(client, clientCert)
+			if err != nil {
+				return "", err
+			}
+			return token.AccessToken, nil
+		}, true},
+		{"missing registration request", func(client *c8y.Client, _ *tls.Certificate) (string, error) {
+			_, resp, err := client.DeviceCredentials.GetNewDeviceRequest(context.Background(), "missing-device")
+			if err == nil {
+				t.Error("expected an error for a missing registration request")
+			}
+			return strconv.Itoa(responseStatusCode(resp)), nil
+		}, false},
+	}
+
+	cassetteFile := filepath.Join(t.TempDir(), "cassette.json")
+	httpCassette = newRecordingCassette(cassetteFile)
+	recorded := map[string]string{}
+	for _, exchange := range exchanges {
+		result, err := exchange.run(platform.adminClient(), &clientCert)
+		if err != nil {
+			t.Fatalf("recording %s: %v", exchange.name, err)
+		}
+		recorded[exchange.name] = result
+	}
+	if http.DefaultTransport.(*http.Transport).Protocols != nil {
+		t.Error("the cassette was attached to the default transport")
+	}
+	content, err := os.ReadFile(cassetteFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{platform.password, recorded["access token"]} {
+		if strings.Contains(string(content), secret) {
+			t.Errorf("cassette contains secret %q", secret)
+		}
+	}
+
+	if httpCassette, err = loadCassette(cassetteFile); err != nil {
+		t.Fatalf("loadCassette() error = %v", err)
+	}
+	// nothing listens on port 1, responses can only come from the cassette
+	offline := newC8yClient("https://127.0.0.1:1", platform.tenantID, platform.user, platform.password)
+	for _, exchange := range exchanges {
+		t.Run(exchange.name, func(t *testing.T) {
+			want := recorded[exchange.name]
+			if exchange.redacted {
+				want = redactedValue
+			}
+			got, err := exchange.run(offline, &clientCert)
+			if err != nil {
+				t.Fatalf("replay error = %v", err)
+			}
+			if got != want {
+				t.Errorf("replayed %q, want %q", got, want)
+			}
+		})
+	}
+}
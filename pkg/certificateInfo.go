@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"time"
+
+	"github.com/reubenmiller/go-c8y/pkg/c8y"
+)
+
+// Certificate metadata published to the device managed object, so dashboards and smart rules of the platform can
+// show which devices have certificates expiring soon.
+
+const certificateInfoFragment = "c8y_CertificateInfo"
+const certificateRenewedEventType = "c8y_CertificateRenewed"
+
+func certificateInfo(cert *x509.Certificate, lastRenewal time.Time) map[string]any {
+	return map[string]any{
+		"serialNumber": serialToHex(cert.SerialNumber),
+		"subject":      cert.Subject.String(),
+		"issuer":       cert.Issuer.String(),
+		"fingerprint":  certificateFingerprint(cert),
+		"notBefore":    cert.NotBefore.UTC().Format(time.RFC3339),
+		"notAfter":     cert.NotAfter.UTC().Format(time.RFC3339),
+		"lastRenewal":  lastRenewal.UTC().Format(time.RFC3339),
+	}
+}
+
+// publishCertificateInfo updates the c8y_CertificateInfo fragment of the device managed object and creates a
+// c8y_CertificateRenewed event. The client must be authenticated as the device.
+func publishCertificateInfo(client *c8y.Client, managedObjectID string, cert *x509.Certificate) error {
+	now := time.Now()
+	info := certificateInfo(cert, now)
+	if _, _, err := client.Inventory.Update(context.TODO(), managedObjectID, map[string]any{certificateInfoFragment: info}); err != nil {
+		return fmt.Errorf("error while updating managed object: %w", err)
+	}
+	_, _, err := client.Event.Create(context.TODO(), map[string]any{
+		"source":                map[string]string{"id": managedObjectID},
+		"type":                  certificateRenewedEventType,
+		"time":                  now.UTC().Format(time.RFC3339),
+		"text":                  fmt.Sprintf("Device certificate renewed (serial %s, valid until %s)", info["serialNumber"], info["notAfter"]),
+		certificateInfoFragment: info,
+	})
+	if err != nil {
+		return fmt.Errorf("error while creating event: %w", err)
+	}
+	return nil
+}
@@ -1,12 +1,28 @@
 package main
 
 import (
+	"crypto/sha1"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"net/http"
 	"os"
+
+	"github.com/reubenmiller/go-c8y/pkg/c8y"
+	"github.com/reubenmiller/go-c8y/pkg/certutil"
+	"github.com/reubenmiller/go-c8y/pkg/password"
 )
 
 const fileNameTemplatePrivateKey = "c8y-private-key-%s.pem"
 const fileNameTemplateCertificate = "c8y-certificate-%s.pem"
 
+// Cumulocity creates a user named "device_<common name>" for each certificate based device
+const deviceUserPrefix = "device_"
+
+// Type of the external ID devices are registered with
+const deviceIdentityType = "c8y_Serial"
+
 const exitCodePrerequisitesNotFulfilled int = 101
 const exitCodeGeneralProcessingError int = 1
 
@@ -24,6 +40,14 @@ func writeToFile(content string, fileName string) error {
 	return nil
 }
 
+// Returns value, or defaultValue if value is empty
+func valueOrDefault(value string, defaultValue string) string {
+	if len(value) == 0 {
+		return defaultValue
+	}
+	return value
+}
+
 func readFromFile(fileName string) ([]byte, error) {
 	b, err := os.ReadFile(fileName)
 	if err != nil {
@@ -31,3 +55,51 @@ func readFromFile(fileName string) ([]byte, error) {
 	}
 	return b, nil
 }
+
+// Returns the SHA-1 fingerprint of a certificate as lower-case hex string (the format Cumulocity uses to identify trusted certificates)
+func certificateFingerprint(cert *x509.Certificate) string {
+	sum := sha1.Sum(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// Creates a certificate signing request for a device with the subject Cumulocity expects (common name is the device ID)
+func createDeviceCSR(deviceID string, key any) (*x509.CertificateRequest, error) {
+	return certutil.CreateCertificateSigningRequest(pkix.Name{
+		CommonName:         deviceID,
+		Organization:       []string{"Cumulocity"},
+		OrganizationalUnit: []string{"Device"},
+	}, key)
+}
+
+// Generates a one-time password for device registrations, with the length and symbols the platform accepts
+func generateOneTimePassword() (string, error) {
+	return password.NewRandomPassword(
+		password.WithLengthConstraints(8, 32),
+		password.WithLength(31),
+		password.WithUrlCompatibleSymbols(2),
+	)
+}
+
+// Creates the Cumulocity client used by all commands. Requests are routed through the active cassette (if any).
+func newC8yClient(host string, tenant string, user string, password string) *c8y.Client {
+	redactSecret(password)
+	if httpCassette == nil {
+		return c8y.NewClient(nil, host, tenant, user, password, false)
+	}
+	return c8y.NewClient(newHTTPClient(nil), host, tenant, user, password, false)
+}
+
+// Creates an HTTP client with the same settings as the go-c8y default client (which ignores self signed
+// certificates), authenticating with the client certificate if given. Requests are routed through the active
+// cassette (if any).
+func newHTTPClient(clientCert *tls.Certificate) *http.Client {
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	if clientCert != nil {
+		tr.TLSClientConfig.Certificates = []tls.Certificate{*clientCert}
+	}
+	if httpCassette != nil {
+		httpCassette.attach(tr)
+	}
+	return &http.Client{Transport: tr}
+}
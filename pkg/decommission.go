@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+)
+
+type CmdGroupDecommission struct {
+	C8yHost             string `long:"cumulocity-host" description:"Provide platform endpoint, e.g. 'https://iot.eu-latest.cumulocity.com'" required:"true"`
+	C8yTenantId         string `long:"cumulocity-tenant-id" description:"Provide platform tenand id, e.g. 't4009123'. Optional (resolved from host when missing)" required:"false"`
+	C8yUser             string `long:"cumulocity-user" description:"Provide your platform user, e.g. 'john.doe@example.org'" required:"true"`
+	C8yPassword         string `long:"cumulocity-password" description:"Provide your platform users password, e.g. 'aVerySecretPass1337'" required:"true"`
+	DeviceId            string `long:"device-id" description:"Provide identifier of the device to decommission, e.g. 'kobu-edge-01'" required:"true"`
+	IdentityType        string `long:"identity-type" description:"Type of the external ID the device managed object is registered with" default:"c8y_Serial"`
+	DeleteManagedObject bool   `long:"delete-managed-object" description:"Also delete the managed object of the device (including its external IDs)"`
+	DeleteLocalFiles    bool   `long:"delete-local-files" description:"Also delete the local private key and certificate files of the device"`
+	PrivateKey          string `long:"private-key" description:"Private key file to delete with --delete-local-files. Default: c8y-private-key-<device-id>.pem"`
+	Certificate         string `long:"certificate" description:"Certificate file to delete with --delete-local-files. Default: c8y-certificate-<device-id>.pem"`
+}
+
+var decommissionCmdName = "decommission"
+var decommissionCmdGroup CmdGroupDecommission
+
+func (g *CmdGroupDecommission) Execute(args []string) error {
+	slog.Info(fmt.Sprintf("Started %s with arguments: C8yHost=%s C8yTenantId=%s C8yUser=%s C8yPassword=%s DeviceId=%s IdentityType=%s DeleteManagedObject=%t DeleteLocalFiles=%t",
+		decommissionCmdName, g.C8yHost, g.C8yTenantId, g.C8yUser, "{obfuscated}", g.DeviceId, g.IdentityType, g.DeleteManagedObject, g.DeleteLocalFiles))
+
+	tenantID := resolveTenantIDOrExit(g.C8yHost, g.C8yTenantId, g.C8yUser, g.C8yPassword)
+	client := newC8yClient(g.C8yHost, tenantID, g.C8yUser, g.C8yPassword)
+
+	slog.Info("Testing user for having the required permissions")
+	if e := checkForRequiredRoles(client, "ROLE_DEVICE_CONTROL_ADMIN"); e != nil {
+		slog.Error("Error while checking User permissions. Exiting now.", "error", e)
+		os.Exit(exitCodePrerequisitesNotFulfilled)
+	}
+
+	deviceID := g.DeviceId
+	state, e := getRegistrationState(client, deviceID, nil, g.IdentityType)
+	if e != nil {
+		slog.Error("Error while retrieving registration state. Exiting now.", "error", e, "deviceID", deviceID)
+		os.Exit(exitCodeGeneralProcessingError)
+	}
+	slog.Info("Current registration state", "deviceID", deviceID, "request", state.RequestStatus, "enrollment", state.Enrollment,
+		"deviceUser", state.DeviceUser, "managedObjectId", state.ManagedObjectID)
+
+	if !g.DeleteManagedObject {
+		// the managed object (and its external ID) is kept, only credentials and registration are removed
+		state.ManagedObjectID = registrationStateNotAvailable
+	}
+	if e := removeDevice(client, state); e != nil {
+		slog.Error("Error while decommissioning device. Exiting now.", "error", e, "deviceID", deviceID)
+		os.Exit(exitCodeGeneralProcessingError)
+	}
+
+	if g.DeleteLocalFiles {
+		privateKeyFileName := valueOrDefault(g.PrivateKey, fmt.Sprintf(fileNameTemplatePrivateKey, deviceID))
+		certFileName := valueOrDefault(g.Certificate, fmt.Sprintf(fileNameTemplateCertificate, deviceID))
+		for _, fileName := range []string{privateKeyFileName, certFileName} {
+			err := os.Remove(fileName)
+			switch {
+			case os.IsNotExist(err):
+			case err != nil:
+				slog.Error("Error while deleting local file. Exiting now.", "error", err, "fileName", fileName)
+				os.Exit(exitCodeGeneralProcessingError)
+			default:
+				slog.Info("Deleted local file", "fileName", fileName)
+			}
+		}
+	}
+
+	slog.Info("Device decommissioned", "deviceID", deviceID)
+	return nil
+}
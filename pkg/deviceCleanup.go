@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/reubenmiller/go-c8y/pkg/c8y"
+)
+
+// Deletes the registration request of a device. A missing request is not an error.
+func deleteRegistrationRequest(client *c8y.Client, deviceID string) error {
+	resp, err := client.DeviceCredentials.Delete(context.TODO(), deviceID)
+	if responseStatusCode(resp) == http.StatusNotFound {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error while deleting registration request: %w", err)
+	}
+	slog.Info("Deleted registration request", "deviceID", deviceID)
+	return nil
+}
+
+// Deletes a device managed object (including its external IDs and device user). A missing managed object is not an error.
+func deleteDeviceManagedObject(client *c8y.Client, managedObjectID string) error {
+	withDeviceUser := true
+	resp, err := client.Inventory.DeleteWithOptions(context.TODO(), managedObjectID, &c8y.ManagedObjectDeleteOptions{DeviceUser: &withDeviceUser})
+	if responseStatusCode(resp) == http.StatusNotFound {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error while deleting managed object %s: %w", managedObjectID, err)
+	}
+	slog.Info("Deleted managed object", "managedObjectId", managedObjectID)
+	return nil
+}
+
+// Deletes the user of a certificate based device. A missing user is not an error.
+func deleteDeviceUser(client *c8y.Client, deviceID string) error {
+	resp, err := client.User.Delete(context.TODO(), deviceUserPrefix+deviceID)
+	if responseStatusCode(resp) == http.StatusNotFound {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error while deleting device user: %w", err)
+	}
+	slog.Info("Deleted device user", "userName", deviceUserPrefix+deviceID)
+	return nil
+}
+
+// Removes everything the platform holds for a device: registration request, managed object and device user
+func removeDevice(client *c8y.Client, state registrationState) error {
+	if state.RequestStatus != registrationStateNotAvailable {
+		if err := deleteRegistrationRequest(client, state.DeviceID); err != nil {
+			return err
+		}
+	}
+	if state.ManagedObjectID != registrationStateNotAvailable {
+		if err := deleteDeviceManagedObject(client, state.ManagedObjectID); err != nil {
+			return err
+		}
+	}
+	if state.DeviceUser != registrationStateNotAvailable {
+		return deleteDeviceUser(client, state.DeviceID)
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/reubenmiller/go-c8y/pkg/c8y"
+)
+
+// readClientCertificateOrExit reads certificate and private key of the device for the mTLS token request
+func readClientCertificateOrExit(certificateFile string, privateKeyFile string) tls.Certificate {
+	certPEM, err := readFromFile(certificateFile)
+	if err != nil {
+		slog.Error("Error when reading file. Exiting now.", "error", err, "fileName", certificateFile)
+		os.Exit(exitCodeGeneralProcessingError)
+	}
+	keyPem, err := readFromFile(privateKeyFile)
+	if err != nil {
+		slog.Error("Error when reading file. Exiting now.", "error", err, "fileName", privateKeyFile)
+		os.Exit(exitCodeGeneralProcessingError)
+	}
+	clientCert, err := tls.X509KeyPair(certPEM, keyPem)
+	if err != nil {
+		slog.Error("Error while processing certificate and private key. Exiting now.", "error", err)
+		os.Exit(exitCodeGeneralProcessingError)
+	}
+	return clientCert
+}
+
+// newDeviceClient returns a client acting as the device, authenticated with the access token of its certificate
+func newDeviceClient(host string, accessToken string) *c8y.Client {
+	client := newC8yClient(host, "", "", "")
+	client.AuthorizationMethod = c8y.AuthMethodOAuth2Internal
+	client.SetToken(accessToken)
+	if claims, err := decodeAccessToken(accessToken); err == nil {
+		client.TenantName = claims.Tenant
+	}
+	return client
+}
+
+// newCertificateClient returns a client for the mTLS endpoint of the platform, authenticating with the client
+// certificate. go-c8y would derive the client for a given certificate from the default transport, bypassing the
+// cassette, so the certificate is set on the transport of this client instead.
+func newCertificateClient(client *c8y.Client, clientCert *tls.Certificate) *c8y.Client {
+	return c8y.NewClient(newHTTPClient(clientCert), client.BaseURL.String(), "", "", "", false)
+}
+
+// findDeviceManagedObject returns the managed object of the device: by its external id or, when the device was
+// registered with another identity type, as the c8y_IsDevice managed object owned by the device user
+func findDeviceManagedObject(client *c8y.Client, identityType string, externalID string, deviceUser string) (*c8y.ManagedObject, error) {
+	identity, resp, err := client.Identity.GetExternalID(context.TODO(), identityType, externalID)
+	switch {
+	case responseStatusCode(resp) == http.StatusNotFound:
+	case err != nil:
+		return nil, fmt.Errorf("error while retrieving external id: %w", err)
+	default:
+		mo, _, err := client.Inventory.GetManagedObject(context.TODO(), identity.ManagedObject.ID, nil)
+		if err != nil {
+			return nil, fmt.Errorf("error while retrieving managed object %s: %w", identity.ManagedObject.ID, err)
+		}
+		return mo, nil
+	}
+
+	collection := &c8y.ManagedObjectCollection{}
+	_, err = client.SendRequest(context.TODO(), c8y.RequestOptions{
+		Method:       http.MethodGet,
+		Path:         "inventory/managedObjects",
+		Query:        url.Values{"owner": {deviceUser}, "fragmentType": {"c8y_IsDevice"}, "pageSize": {"1"}}.Encode(),
+		ResponseData: collection,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error while searching managed object of device user: %w", err)
+	}
+	if len(collection.ManagedObjects) == 0 {
+		return nil, nil
+	}
+	return &collection.ManagedObjects[0], nil
+}
+
+// getExternalIDs returns all external ids of a managed object
+func getExternalIDs(client *c8y.Client, managedObjectID string) ([]c8y.Identity, error) {
+	collection := struct {
+		ExternalIDs []c8y.Identity `json:"externalIds"`
+	}{}
+	_, err := client.SendRequest(context.TODO(), c8y.RequestOptions{
+		Method:       http.MethodGet,
+		Path:         "identity/globalIds/" + managedObjectID + "/externalIds",
+		ResponseData: &collection,
+	})
+	return collection.ExternalIDs, err
+}
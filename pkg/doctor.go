@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/reubenmiller/go-c8y/pkg/c8y"
+)
+
+type CmdGroupDoctor struct {
+	C8yHost         string        `long:"cumulocity-host" description:"Provide platform endpoint, e.g. 'https://iot.eu-latest.cumulocity.com'" required:"true"`
+	C8yTenantId     string        `long:"cumulocity-tenant-id" description:"Provide platform tenand id, e.g. 't4009123'. Optional (resolved from host when missing)" required:"false"`
+	C8yUser         string        `long:"cumulocity-user" description:"Provide your platform user, e.g. 'john.doe@example.org'" required:"true"`
+	C8yPassword     string        `long:"cumulocity-password" description:"Provide your platform users password, e.g. 'aVerySecretPass1337'" required:"true"`
+	MaxClockSkew    time.Duration `long:"max-clock-skew" description:"Maximum accepted difference between local and server clock" default:"1m"`
+	CaExpiryWarning time.Duration `long:"ca-expiry-warning" description:"Warn when the CA certificate expires within this duration" default:"720h"`
+}
+
+var doctorCmdName = "doctor"
+var doctorCmdGroup CmdGroupDoctor
+
+const (
+	checkStatusPass = "PASS"
+	checkStatusWarn = "WARN"
+	checkStatusFail = "FAIL"
+	checkStatusSkip = "SKIP"
+)
+
+const certificateAuthorityFeature = "certificate-authority"
+
+// Result of a single prerequisite check
+type checkResult struct {
+	Name   string
+	Status string
+	Detail string
+}
+
+func (g *CmdGroupDoctor) Execute(args []string) error {
+	slog.Info(fmt.Sprintf("Started %s with arguments: C8yHost=%s C8yTenantId=%s C8yUser=%s C8yPassword=%s",
+		doctorCmdName, g.C8yHost, g.C8yTenantId, g.C8yUser, "{obfuscated}"))
+
+	results := []checkResult{}
+	add := func(name string, status string, detail string) {
+		results = append(results, checkResult{Name: name, Status: status, Detail: detail})
+	}
+
+	// same fallback as the register commands: a provided tenant id is used when it can't be resolved from the host
+	tenantID, err := resolveTenantID(g.C8yHost, g.C8yUser, g.C8yPassword)
+	switch {
+	case err == nil:
+		add("Tenant ID from host", checkStatusPass, "Host belongs to tenant "+tenantID)
+	case len(g.C8yTenantId) > 0:
+		tenantID = g.C8yTenantId
+		add("Tenant ID from host", checkStatusWarn, fmt.Sprintf("%s. Continuing with provided tenant id '%s'", err.Error(), g.C8yTenantId))
+	default:
+		add("Tenant ID from host", checkStatusFail, err.Error()+". Provide --cumulocity-tenant-id")
+	}
+	client := newC8yClient(g.C8yHost, tenantID, g.C8yUser, g.C8yPassword)
+
+	if httpCassette != nil && httpCassette.replay {
+		add("Host reachable (TLS)", checkStatusSkip, "Not available in replay mode")
+		add("Device endpoint reachable (8443)", checkStatusSkip, "Not available in replay mode")
+	} else {
+		add(checkTLSEndpoint("Host reachable (TLS)", client.BaseURL, ""))
+		add(checkTLSEndpoint("Device endpoint reachable (8443)", client.BaseURL, "8443"))
+	}
+
+	currentTenant, resp, err := client.Tenant.GetCurrentTenant(context.Background())
+	tenantResolved := err == nil
+	switch {
+	case err != nil:
+		add("Tenant resolution", checkStatusFail, "Error while retrieving current tenant: "+err.Error())
+	case len(g.C8yTenantId) > 0 && currentTenant.Name != g.C8yTenantId:
+		tenantResolved = false
+		add("Tenant resolution", checkStatusFail, fmt.Sprintf("Host belongs to tenant '%s' but '%s' was provided", currentTenant.Name, g.C8yTenantId))
+	default:
+		add("Tenant resolution", checkStatusPass, fmt.Sprintf("Tenant %s (%s)", currentTenant.Name, currentTenant.DomainName))
+	}
+
+	add(checkClockSkew(resp, g.MaxClockSkew))
+
+	if !tenantResolved {
+		add("User roles", checkStatusSkip, "Tenant could not be resolved")
+		add("CA feature enabled", checkStatusSkip, "Tenant could not be resolved")
+		add("CA certificate", checkStatusSkip, "Tenant could not be resolved")
+	} else {
+		if err := checkForRequiredRoles(client, "ROLE_DEVICE_CONTROL_ADMIN"); err != nil {
+			add("User roles", checkStatusFail, err.Error())
+		} else {
+			add("User roles", checkStatusPass, "User has ROLE_DEVICE_CONTROL_ADMIN")
+		}
+
+		feature, _, err := client.Features.GetFeature(context.Background(), certificateAuthorityFeature)
+		switch {
+		case err != nil:
+			add("CA feature enabled", checkStatusFail, "Error while retrieving feature toggle: "+err.Error())
+		case !feature.Active:
+			add("CA feature enabled", checkStatusFail, "Feature '"+certificateAuthorityFeature+"' is not active in tenant")
+		default:
+			add("CA feature enabled", checkStatusPass, "Feature '"+certificateAuthorityFeature+"' is active")
+		}
+
+		add(checkCACertificate(client, g.CaExpiryWarning))
+	}
+
+	add(checkWorkingDir())
+
+	failed := false
+	for _, r := range results {
+		fmt.Printf("[%s] %-34s %s\n", r.Status, r.Name, r.Detail)
+		failed = failed || r.Status == checkStatusFail
+	}
+	if failed {
+		fmt.Println("Doctor result: NOT_OK")
+		os.Exit(exitCodePrerequisitesNotFulfilled)
+	}
+	fmt.Println("Doctor result: OK")
+	return nil
+}
+
+// Connects to the given endpoint (port of the base URL when empty) and performs a TLS handshake
+func checkTLSEndpoint(name string, baseURL *url.URL, port string) (string, string, string) {
+	if len(port) == 0 {
+		port = baseURL.Port()
+	}
+	if len(port) == 0 {
+		port = "443"
+	}
+	address := net.JoinHostPort(baseURL.Hostname(), port)
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 10 * time.Second}, "tcp", address, &tls.Config{
+		InsecureSkipVerify: true,
+		ServerName:         baseURL.Hostname(),
+	})
+	if err != nil {
+		return name, checkStatusFail, fmt.Sprintf("Error while connecting to %s: %s", address, err.Error())
+	}
+	defer conn.Close()
+
+	state := conn.ConnectionState()
+	detail := fmt.Sprintf("Connected to %s using %s", address, tls.VersionName(state.Version))
+	if len(state.PeerCertificates) == 0 {
+		return name, checkStatusWarn, detail + ", server did not present a certificate"
+	}
+	intermediates := x509.NewCertPool()
+	for _, c := range state.PeerCertificates[1:] {
+		intermediates.AddCert(c)
+	}
+	serverCert := state.PeerCertificates[0]
+	if _, err := serverCert.Verify(x509.VerifyOptions{DNSName: baseURL.Hostname(), Intermediates: intermediates}); err != nil {
+		return name, checkStatusWarn, detail + ", server certificate is not trusted by this system: " + err.Error()
+	}
+	return name, checkStatusPass, fmt.Sprintf("%s, server certificate valid until %s", detail, serverCert.NotAfter.Format(time.RFC3339))
+}
+
+// Compares the local clock with the Date header of a server response
+func checkClockSkew(resp *c8y.Response, maxSkew time.Duration) (string, string, string) {
+	name := "Clock skew"
+	if resp == nil || resp.Response == nil || len(resp.Response.Header.Get("Date")) == 0 {
+		return name, checkStatusSkip, "Server did not respond with a Date header"
+	}
+	serverTime, err := http.ParseTime(resp.Response.Header.Get("Date"))
+	if err != nil {
+		return name, checkStatusSkip, "Invalid Date header: " + err.Error()
+	}
+	skew := time.Since(serverTime).Round(time.Second)
+	detail := fmt.Sprintf("Local clock differs by %s from server (max %s)", skew, maxSkew)
+	if skew > maxSkew || -skew > maxSkew {
+		return name, checkStatusFail, detail + ". Certificates might be rejected as not yet valid or expired"
+	}
+	return name, checkStatusPass, detail
+}
+
+func checkCACertificate(client *c8y.Client, expiryWarning time.Duration) (string, string, string) {
+	name := "CA certificate"
+	ca, err := client.CertificateAuthority.Get(context.Background())
+	if errors.Is(err, c8y.ErrNotFound) || (err == nil && ca == nil) {
+		return name, checkStatusFail, "No CA certificate found in tenant"
+	}
+	if err != nil {
+		return name, checkStatusFail, "Error while retrieving CA certificate: " + err.Error()
+	}
+	notAfter, err := time.Parse(time.RFC3339, ca.NotAfter)
+	if err != nil {
+		return name, checkStatusWarn, fmt.Sprintf("CA '%s' found but expiry '%s' could not be parsed", ca.Name, ca.NotAfter)
+	}
+	remaining := time.Until(notAfter)
+	detail := fmt.Sprintf("CA '%s' (fingerprint %s) valid until %s", ca.Name, ca.Fingerprint, notAfter.Format(time.RFC3339))
+	switch {
+	case remaining <= 0:
+		return name, checkStatusFail, detail + " - expired"
+	case remaining < expiryWarning:
+		return name, checkStatusWarn, fmt.Sprintf("%s - expires in %s", detail, remaining.Round(time.Hour))
+	}
+	return name, checkStatusPass, detail
+}
+
+// Tests if files can be created in the current working directory, the register commands place key and certificate
+// there
+func checkWorkingDir() (string, string, string) {
+	name := "Working directory writable"
+	dir, err := os.Getwd()
+	if err != nil {
+		return name, checkStatusFail, "Error while resolving working directory: " + err.Error()
+	}
+	f, err := os.CreateTemp(dir, ".c8y-certificate-cli-doctor-*")
+	if err != nil {
+		return name, checkStatusFail, err.Error()
+	}
+	f.Close()
+	os.Remove(f.Name())
+	return name, checkStatusPass, "Files can be written to " + dir
+}
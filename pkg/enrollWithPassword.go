@@ -8,30 +8,41 @@ import (
 	"errors"
 	"fmt"
 	"log/slog"
+	"net/http"
+	"net/url"
 	"os"
 	"strings"
-	"time"
 
 	"github.com/reubenmiller/go-c8y/pkg/c8y"
 	"github.com/reubenmiller/go-c8y/pkg/certutil"
 )
 
 type CmdGroupRegisterUsingPassword struct {
-	C8yHost     string `long:"cumulocity-host" description:"Provide platform endpoint, e.g. 'https://iot.eu-latest.cumulocity.com'" required:"true"`
-	C8yTenantId string `long:"cumulocity-tenant-id" description:"Provide platform tenand id, e.g. 't4009123'" required:"true"`
-	DeviceId    string `long:"device-id" description:"Provide identifier for your Cloud device, e.g. 'kobu-edge-01'. Free text but needs to be unique." required:"true"`
-	C8yUser     string `long:"cumulocity-user" description:"Provide your platform user, e.g. 'john.doe@example.org'" required:"true"`
-	C8yPassword string `long:"cumulocity-password" description:"Provide your platform users password, e.g. 'aVerySecretPass1337'" required:"true"`
+	C8yHost       string `long:"cumulocity-host" description:"Provide platform endpoint, e.g. 'https://iot.eu-latest.cumulocity.com'" required:"true"`
+	C8yTenantId   string `long:"cumulocity-tenant-id" description:"Provide platform tenand id, e.g. 't4009123'. Optional (resolved from host when missing)" required:"false"`
+	DeviceId      string `long:"device-id" description:"Provide identifier for your Cloud device, e.g. 'kobu-edge-01'. Free text but needs to be unique." required:"true"`
+	C8yUser       string `long:"cumulocity-user" description:"Provide your platform user, e.g. 'john.doe@example.org'" required:"true"`
+	C8yPassword   string `long:"cumulocity-password" description:"Provide your platform users password, e.g. 'aVerySecretPass1337'" required:"true"`
+	KeepOnFailure bool   `long:"keep-on-failure" description:"Don't roll back the objects created by a failed run (registration request, device user, managed object, files), only report them"`
+	IfExists      string `long:"if-exists" description:"Policy when the device is registered already: fail, skip (do nothing), reenroll (new registration request and certificate, keeping the device) or replace (delete device and register from scratch)" choice:"fail" choice:"skip" choice:"reenroll" choice:"replace" default:"fail"`
 }
 
+const (
+	ifExistsFail     = "fail"
+	ifExistsSkip     = "skip"
+	ifExistsReenroll = "reenroll"
+	ifExistsReplace  = "replace"
+)
+
 var regUsingPassCmdGroupName = "registerUsingPassword"
 var regUsingPassCmdGroup CmdGroupRegisterUsingPassword
 
 func (g *CmdGroupRegisterUsingPassword) Execute(args []string) error {
-	slog.Info(fmt.Sprintf("Started with arguments: C8yHost=%s C8yTenantId=%s C8yUser=%s C8yPassword=%s DeviceId=%s",
-		g.C8yHost, g.C8yTenantId, g.C8yUser, "{obfuscated}", g.DeviceId))
+	slog.Info(fmt.Sprintf("Started with arguments: C8yHost=%s C8yTenantId=%s C8yUser=%s C8yPassword=%s DeviceId=%s IfExists=%s KeepOnFailure=%t",
+		g.C8yHost, g.C8yTenantId, g.C8yUser, "{obfuscated}", g.DeviceId, g.IfExists, g.KeepOnFailure))
 
-	client := c8y.NewClient(nil, g.C8yHost, g.C8yTenantId, g.C8yUser, g.C8yPassword, false)
+	tenantID := resolveTenantIDOrExit(g.C8yHost, g.C8yTenantId, g.C8yUser, g.C8yPassword)
+	client := newC8yClient(g.C8yHost, tenantID, g.C8yUser, g.C8yPassword)
 	currentTenant, _, e := client.Tenant.GetCurrentTenant(context.TODO())
 	if e != nil {
 		slog.Error("Error while retrieving current tenant. Did you set the expected environment variables? Exiting now.", "error", e)
@@ -53,83 +64,187 @@ func (g *CmdGroupRegisterUsingPassword) Execute(args []string) error {
 	}
 
 	deviceID := g.DeviceId
+	slog.Info("Testing if device is registered already", "deviceID", deviceID)
+	state, e := getRegistrationState(client, deviceID, nil, deviceIdentityType)
+	if e != nil {
+		slog.Error("Error while retrieving registration state. Exiting now.", "error", e, "deviceID", deviceID)
+		os.Exit(exitCodeGeneralProcessingError)
+	}
+	if state.Enrollment != enrollmentStateNotRegistered {
+		slog.Info("Device is registered already", "deviceID", deviceID, "request", state.RequestStatus, "enrollment", state.Enrollment,
+			"deviceUser", state.DeviceUser, "managedObjectId", state.ManagedObjectID, "ifExists", g.IfExists)
+		switch g.IfExists {
+		case ifExistsSkip:
+			slog.Info("Skipping registration of existing device", "deviceID", deviceID)
+			return nil
+		case ifExistsReenroll:
+			if state.RequestStatus != registrationStateNotAvailable {
+				if e := deleteRegistrationRequest(client, deviceID); e != nil {
+					slog.Error("Error while cleaning up registration request. Exiting now.", "error", e, "deviceID", deviceID)
+					os.Exit(exitCodeGeneralProcessingError)
+				}
+			}
+		case ifExistsReplace:
+			if e := removeDevice(client, state); e != nil {
+				slog.Error("Error while removing existing device. Exiting now.", "error", e, "deviceID", deviceID)
+				os.Exit(exitCodeGeneralProcessingError)
+			}
+		default:
+			slog.Error("Device is registered already. Use --if-exists to skip, re-enroll or replace it. Exiting now.", "deviceID", deviceID)
+			os.Exit(exitCodePrerequisitesNotFulfilled)
+		}
+	}
+
+	// devices which are re-enrolled keep their device user and managed object, even if the run fails
+	keepDevice := state.Enrollment != enrollmentStateNotRegistered && g.IfExists == ifExistsReenroll
+	journal := newRollbackJournal(g.KeepOnFailure)
+
 	otp, e := client.DeviceEnrollment.GenerateOneTimePassword()
 	if e != nil {
 		slog.Error("Error while creating one time password", "error", e, "deviceID", deviceID)
 		os.Exit(exitCodeGeneralProcessingError)
 	}
+	redactSecret(otp)
 
 	slog.Info("Creating bulk registration request for device-id", "deviceID", deviceID)
-	if e = createBulkRegistrationRequest(deviceID, otp, client); e != nil {
+	if e := createJournaledRegistrationRequest(client, deviceID, otp, journal); e != nil {
 		slog.Error("Error while creating bulk registration request. Exiting now.", "error", e, "deviceID", deviceID)
-		os.Exit(exitCodeGeneralProcessingError)
+		journal.exit(exitCodeGeneralProcessingError)
 	}
 
 	slog.Info("Creating private key for device-id", "deviceID", deviceID)
 	keyPem, e := certutil.MakeEllipticPrivateKeyPEM()
 	if e != nil {
 		slog.Error("Error wile creating private key. Exiting now.", "error", e, "deviceID", deviceID)
-		os.Exit(exitCodeGeneralProcessingError)
+		journal.exit(exitCodeGeneralProcessingError)
 	}
 
 	slog.Info("Parsing Private Key from PEM", "deviceID", deviceID)
 	key, e := certutil.ParsePrivateKeyPEM(keyPem)
 	if e != nil {
 		slog.Error("Error wile parsing private key. Exiting now.", "error", e, "deviceID", deviceID)
-		os.Exit(exitCodeGeneralProcessingError)
+		journal.exit(exitCodeGeneralProcessingError)
 	}
 
 	slog.Info("Creating certificate signing request", "deviceID", deviceID)
 	csr, err := client.DeviceEnrollment.CreateCertificateSigningRequest(g.DeviceId, key)
 	if err != nil {
 		slog.Error("Error while creating Certificate signing request. Exiting now.", "error", err)
-		os.Exit(exitCodeGeneralProcessingError)
+		journal.exit(exitCodeGeneralProcessingError)
 	}
 
 	if e != nil {
 		slog.Error("Error while creating CSR. Exiting now.", "error", e)
-		os.Exit(exitCodeGeneralProcessingError)
+		journal.exit(exitCodeGeneralProcessingError)
 	}
 
 	slog.Info("Enrolling Device", "deviceID", deviceID)
-	certPEM, e := enrollDevice(client, deviceID, otp, csr, 5)
+	certPEM, e := enrollDevice(client, deviceID, otp, csr)
 	if e != nil {
 		slog.Error("Error while enrolling device", "error", e)
-		os.Exit(exitCodeGeneralProcessingError)
+		journal.exit(exitCodeGeneralProcessingError)
+	}
+	if !keepDevice {
+		journal.add("device user and managed object of "+deviceID, func() error {
+			created, err := getRegistrationState(client, deviceID, nil, deviceIdentityType)
+			if err != nil {
+				return err
+			}
+			created.RequestStatus = registrationStateNotAvailable
+			return removeDevice(client, created)
+		})
 	}
+	journal.add("certificate issued for "+deviceID, func() error {
+		return errors.New("an issued certificate can't be withdrawn, it stays valid until it expires")
+	})
 
 	privateKeyFileName := fmt.Sprintf(fileNameTemplatePrivateKey, deviceID)
 	certFileName := fmt.Sprintf(fileNameTemplateCertificate, deviceID)
-	writeToFile(string(keyPem), privateKeyFileName)
-	writeToFile(string(certPEM), certFileName)
+	for _, file := range []struct{ name, content string }{{privateKeyFileName, string(keyPem)}, {certFileName, string(certPEM)}} {
+		if _, err := os.Stat(file.name); os.IsNotExist(err) {
+			journal.add("file "+file.name, func() error {
+				if err := os.Remove(file.name); err != nil && !os.IsNotExist(err) {
+					return err
+				}
+				return nil
+			})
+		}
+		if e := writeToFile(file.content, file.name); e != nil {
+			slog.Error("Error while writing file. Exiting now.", "error", e, "fileName", file.name)
+			journal.exit(exitCodeGeneralProcessingError)
+		}
+	}
 	slog.Info(fmt.Sprintf("Certificate retrieval succeeded. Placed files '%s' and '%s' in current working directory.",
 		privateKeyFileName, certFileName))
 
 	return nil
 }
 
-func enrollDevice(client *c8y.Client, deviceID string, otp string, csr *x509.CertificateRequest, maxRetries int) ([]byte, error) {
-	attempt := 0
+func enrollDevice(client *c8y.Client, deviceID string, otp string, csr *x509.CertificateRequest) ([]byte, error) {
 	var cert *x509.Certificate
-	for {
-		attempt++
+	err := withRetry("device enrollment", func() (*c8y.Response, error) {
 		var resp *c8y.Response
 		var e error
 		cert, resp, e = client.DeviceEnrollment.Enroll(context.TODO(), deviceID, otp, csr)
-		if e == nil && resp.Response.StatusCode == 200 {
-			slog.Info("Device enrollment request succeeded", "deviceID", deviceID, "attempt", attempt, "statusCode", resp.Response.StatusCode)
-			slog.Info("Marshal certificate to PEM")
-			certPEM := certutil.MarshalCertificateToPEM(cert.Raw)
-			return certPEM, nil
-		} else {
-			if attempt == maxRetries {
-				return nil, errors.New("Giving up device enrollment request after 5 retrials")
+		if e == nil && responseStatusCode(resp) != 200 {
+			e = fmt.Errorf("Unexpected response code %d for device enrollment. Expected 200.", responseStatusCode(resp))
+		}
+		return resp, e
+	})
+	if err != nil {
+		return nil, err
+	}
+	if cert == nil {
+		return nil, errors.New("Device enrollment response did not contain a certificate")
+	}
+	slog.Info("Device enrollment request succeeded", "deviceID", deviceID)
+	slog.Info("Marshal certificate to PEM")
+	return certutil.MarshalCertificateToPEM(cert.Raw), nil
+}
+
+// Resolves the tenant id of a host. The (unauthenticated) login options are tried first, then the current tenant
+// is requested with credentials that don't contain a tenant.
+func resolveTenantID(host string, user string, password string) (string, error) {
+	client := newC8yClient(host, "", user, password)
+	loginOptions, resp, err := client.Tenant.GetLoginOptions(context.TODO())
+	if err == nil {
+		for _, option := range resp.JSON("loginOptions").Array() {
+			if tenantID := option.Get("tenantId").String(); len(tenantID) > 0 {
+				return tenantID, nil
+			}
+		}
+		for _, option := range loginOptions.LoginOptions {
+			if initRequest, err := url.Parse(option.InitRequest); err == nil && len(initRequest.Query().Get("tenant_id")) > 0 {
+				return initRequest.Query().Get("tenant_id"), nil
 			}
-			slog.Warn("Error while device enrollment. Retrying in 3 seconds.", "deviceID", deviceID, "statusCode", resp.Response.StatusCode, "error", e, "attempt", attempt)
-			time.Sleep(time.Second * 3)
 		}
 	}
 
+	currentTenant, _, err := client.Tenant.GetCurrentTenant(context.TODO())
+	if err != nil {
+		return "", errors.New("Tenant could neither be resolved from login options nor current tenant: " + err.Error())
+	}
+	return currentTenant.Name, nil
+}
+
+// Resolves the tenant id of a host and compares it with the provided one (optional). Exits with
+// exitCodePrerequisitesNotFulfilled if the tenant can't be determined or doesn't match.
+func resolveTenantIDOrExit(host string, providedTenantID string, user string, password string) string {
+	tenantID, e := resolveTenantID(host, user, password)
+	if e != nil {
+		if len(providedTenantID) == 0 {
+			slog.Error("Error while resolving tenant id from host. Please provide --cumulocity-tenant-id. Exiting now.", "error", e)
+			os.Exit(exitCodePrerequisitesNotFulfilled)
+		}
+		slog.Warn("Could not resolve tenant id from host. Continuing with provided tenant id.", "error", e, "tenantId", providedTenantID)
+		tenantID = providedTenantID
+	}
+	if len(providedTenantID) > 0 && providedTenantID != tenantID {
+		slog.Error(fmt.Sprintf("Host %s belongs to tenant '%s' but tenant '%s' was provided. Exiting now.", host, tenantID, providedTenantID))
+		os.Exit(exitCodePrerequisitesNotFulfilled)
+	}
+	slog.Info("Using tenant " + tenantID)
+	return tenantID
 }
 
 // Requests users current permissions and checks if provided requiredRole is part of it. Returns error if not.
@@ -151,6 +266,29 @@ func checkForRequiredRoles(client *c8y.Client, requiredRole string) error {
 	return nil
 }
 
+// Creates the registration request and adds its deletion to the journal. A request which existed before (e.g. created
+// by an operator meanwhile) is not deleted on rollback, also if the creation failed.
+func createJournaledRegistrationRequest(client *c8y.Client, deviceID string, otp string, journal *rollbackJournal) error {
+	_, resp, err := client.DeviceCredentials.GetNewDeviceRequest(context.TODO(), deviceID)
+	if err != nil && responseStatusCode(resp) != http.StatusNotFound {
+		return fmt.Errorf("error while checking for an existing registration request: %w", err)
+	}
+	if err == nil {
+		slog.Warn("Registration request exists already, it is kept on rollback", "deviceID", deviceID)
+		return createBulkRegistrationRequest(deviceID, otp, client)
+	}
+	deleteRequest := func() error { return deleteRegistrationRequest(client, deviceID) }
+	if err := createBulkRegistrationRequest(deviceID, otp, client); err != nil {
+		// the request might have been created even though the response got lost
+		if _, _, getErr := client.DeviceCredentials.GetNewDeviceRequest(context.TODO(), deviceID); getErr == nil {
+			journal.add("registration request of "+deviceID, deleteRequest)
+		}
+		return err
+	}
+	journal.add("registration request of "+deviceID, deleteRequest)
+	return nil
+}
+
 func createBulkRegistrationRequest(deviceID string, otp string, client *c8y.Client) error {
 	csvContents := bytes.NewBufferString("")
 	csvWriter := csv.NewWriter(csvContents)
@@ -170,17 +308,22 @@ func createBulkRegistrationRequest(deviceID string, otp string, client *c8y.Clie
 		otp,
 		deviceID,
 		"test_ci_reg",
-		"c8y_Serial",
+		deviceIdentityType,
 		"true",
 	})
 	csvWriter.Flush()
-	_, resp, err := client.DeviceCredentials.CreateBulk(context.TODO(), csvContents)
-	slog.Info("Response status code for bulk registration request", "deviceID", deviceID, "statusCode", resp.Response.StatusCode)
-	if err != nil {
-		return err
-	}
-	if resp.Response.StatusCode != 201 {
-		return errors.New(fmt.Sprintf("Invalid response status code %d from platform. Expected 201.", resp.Response.StatusCode))
-	}
-	return nil
+	csvBytes := csvContents.Bytes()
+	return withRetry("bulk registration", func() (*c8y.Response, error) {
+		// the form data is consumed by each attempt
+		result, resp, err := client.DeviceCredentials.CreateBulk(context.TODO(), bytes.NewReader(csvBytes))
+		slog.Info("Response status code for bulk registration request", "deviceID", deviceID, "statusCode", responseStatusCode(resp))
+		if err == nil && responseStatusCode(resp) != 201 {
+			err = errors.New(fmt.Sprintf("Invalid response status code %d from platform. Expected 201.", responseStatusCode(resp)))
+		}
+		// the platform responds with 201 even if the registration of the device failed
+		if err == nil && len(result.FailedCreationList) > 0 {
+			err = errors.New("Bulk registration failed: " + result.FailedCreationList[0].FailureReason)
+		}
+		return resp, err
+	})
 }
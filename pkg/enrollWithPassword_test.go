@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/reubenmiller/go-c8y/pkg/c8y"
+)
+
+func TestCreateJournaledRegistrationRequest(t *testing.T) {
+	const deviceID = "journal-device"
+	tests := []struct {
+		name string
+		// existing registration request of the device, none if empty
+		existingStatus string
+		// the response of the bulk registration gets lost after the platform processed it
+		loseResponse        bool
+		password            string
+		wantErr             bool
+		wantJournaled       int
+		wantRequestRollback bool
+	}{
+		{"created request is deleted on rollback", "", false, "admin", false, 1, false},
+		{"existing request is kept on rollback", c8y.NewDeviceRequestWaitingForConnection, false, "admin", true, 0, true},
+		{"request created despite lost response is deleted on rollback", "", true, "admin", true, 1, false},
+		{"nothing is journaled if the platform rejects the request", "", false, "wrong", true, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			platform := startTestPlatform(t)
+			setRetryPolicy(t, retryPolicy{MaxAttempts: 1})
+			if len(tt.existingStatus) > 0 {
+				platform.registrations[deviceID] = &mockRegistration{ID: deviceID, Status: tt.existingStatus, IdentityType: deviceIdentityType}
+			}
+			host := platform.host
+			if tt.loseResponse {
+				host = serveLosingResponses(t, platform, "POST /devicecontrol/bulkNewDeviceRequests")
+			}
+
+			client := newC8yClient(host, platform.tenantID, platform.user, tt.password)
+			journal := newRollbackJournal(false)
+			err := createJournaledRegistrationRequest(client, deviceID, "otp-123456", journal)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("createJournaledRegistrationRequest() error = %v, want error %t", err, tt.wantErr)
+			}
+			if len(journal.steps) != tt.wantJournaled {
+				t.Fatalf("journaled steps = %d, want %d", len(journal.steps), tt.wantJournaled)
+			}
+
+			journal.rollback()
+			platform.mu.Lock()
+			_, exists := platform.registrations[deviceID]
+			platform.mu.Unlock()
+			if exists != tt.wantRequestRollback {
+				t.Errorf("registration request exists after rollback = %t, want %t", exists, tt.wantRequestRollback)
+			}
+		})
+	}
+}
+
+// serveLosingResponses serves the API of the platform, but answers the given requests with 502 after processing them
+func serveLosingResponses(t *testing.T, platform *testPlatform, pattern string) string {
+	t.Helper()
+	api := platform.apiHandler()
+	mux := http.NewServeMux()
+	mux.Handle("/", api)
+	mux.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+		api.ServeHTTP(httptest.NewRecorder(), r)
+		writeMockError(w, http.StatusBadGateway, "gateway/Error", "Response lost")
+	})
+	server := httptest.NewUnstartedServer(mux)
+	server.TLS = platform.apiTLSConfig()
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return server.URL
+}
@@ -2,9 +2,11 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"log/slog"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/reubenmiller/go-c8y/pkg/c8y"
@@ -15,16 +17,37 @@ type CmdGroupEnrollmentPoller struct {
 	C8yHost  string `long:"cumulocity-host" description:"Provide platform endpoint, e.g. 'https://iot.eu-latest.cumulocity.com'" required:"true"`
 	DeviceId string `long:"device-id" description:"Provide identifier for your Cloud device, e.g. 'kobu-edge-01'. Free text but needs to be unique." required:"true"`
 	Otp      string `long:"one-time-password" description:"One time password to be used for enrollment. Optional (auto-created when missing)" required:"false"`
+
+	InitDelay    time.Duration `long:"init-delay" description:"Delay before the first attempt to download the certificate" default:"2s"`
+	PollInterval time.Duration `long:"poll-interval" description:"Interval between two attempts to download the certificate" default:"5s"`
+	Timeout      time.Duration `long:"timeout" description:"Overall time to wait for the registration, e.g. '4h' for long running manufacturing" default:"10m"`
+	Headless     bool          `long:"headless" description:"Don't show the terminal banner (QR code). Emit enrollment URL, one-time password and progress as JSON lines on stdout instead"`
+
+	QrCodeFile string `long:"qr-code-file" description:"Write the QR code of the enrollment URL to file (.png or .svg)"`
+	LabelFile  string `long:"label-file" description:"Write a printable label (.svg) with QR code, device ID and one-time password to file"`
+}
+
+// Structured output of the poller in headless mode (one JSON object per line)
+type pollerEvent struct {
+	Event           string `json:"event"`
+	Time            string `json:"time"`
+	ExternalID      string `json:"externalId"`
+	OneTimePassword string `json:"oneTimePassword,omitempty"`
+	URL             string `json:"url,omitempty"`
+	StatusCode      int    `json:"statusCode,omitempty"`
+	Error           string `json:"error,omitempty"`
+	CertificateFile string `json:"certificateFile,omitempty"`
+	PrivateKeyFile  string `json:"privateKeyFile,omitempty"`
 }
 
 var regUsingPollerCmdName = "registerUsingPoller"
 var regUsingPollerCmdGroup CmdGroupEnrollmentPoller
 
 func (g *CmdGroupEnrollmentPoller) Execute(args []string) error {
-	slog.Info(fmt.Sprintf("Started %s with arguments: C8yHost=%s C8yTenantId=%s DeviceId=%s",
-		regUsingPollerCmdName, g.C8yHost, "", g.DeviceId))
+	slog.Info(fmt.Sprintf("Started %s with arguments: C8yHost=%s C8yTenantId=%s DeviceId=%s InitDelay=%s PollInterval=%s Timeout=%s Headless=%t QrCodeFile=%s LabelFile=%s",
+		regUsingPollerCmdName, g.C8yHost, "", g.DeviceId, g.InitDelay, g.PollInterval, g.Timeout, g.Headless, g.QrCodeFile, g.LabelFile))
 
-	client := c8y.NewClient(nil, g.C8yHost, "", "", "", false)
+	client := newC8yClient(g.C8yHost, "", "", "")
 
 	keyPem, err := certutil.MakeEllipticPrivateKeyPEM()
 	if err != nil {
@@ -57,28 +80,72 @@ func (g *CmdGroupEnrollmentPoller) Execute(args []string) error {
 			os.Exit(exitCodeGeneralProcessingError)
 		}
 	}
+	redactSecret(otp)
+
+	if len(g.QrCodeFile) > 0 {
+		if err := writeQRCode(enrollmentURL(client, g.DeviceId, otp), g.QrCodeFile); err != nil {
+			slog.Error("Error while writing QR code. Exiting now.", "error", err, "fileName", g.QrCodeFile)
+			os.Exit(exitCodeGeneralProcessingError)
+		}
+		slog.Info("Wrote enrollment QR code", "fileName", g.QrCodeFile)
+	}
+	if len(g.LabelFile) > 0 {
+		if err := writeEnrollmentLabel(g.LabelFile, g.DeviceId, otp, client.BaseURL.Host, enrollmentURL(client, g.DeviceId, otp)); err != nil {
+			slog.Error("Error while writing label. Exiting now.", "error", err, "fileName", g.LabelFile)
+			os.Exit(exitCodeGeneralProcessingError)
+		}
+		slog.Info("Wrote enrollment label", "fileName", g.LabelFile)
+	}
+
+	banner := &c8y.DeviceEnrollmentBannerOptions{
+		Enable:     true,
+		ShowQRCode: true,
+		ShowURL:    true,
+	}
+	onProgressBefore := func() {
+		fmt.Fprintf(os.Stderr, "\rTrying to download certificate: ")
+	}
+	onProgressError := func(r *c8y.Response, err error) {
+		status := ""
+		if r != nil {
+			status = r.Status()
+		}
+		fmt.Fprintf(os.Stderr, "WAITING (last statusCode=%s, time=%s)\n", status, time.Now().Format(time.RFC3339))
+	}
+	if g.Headless {
+		banner = nil
+		onProgressBefore = nil
+		onProgressError = func(r *c8y.Response, err error) {
+			event := pollerEvent{Event: "waiting", ExternalID: g.DeviceId, StatusCode: responseStatusCode(r)}
+			if err != nil {
+				event.Error = err.Error()
+			}
+			emitPollerEvent(event)
+		}
+		emitPollerEvent(pollerEvent{
+			Event:           "registration_required",
+			ExternalID:      g.DeviceId,
+			OneTimePassword: otp,
+			URL:             enrollmentURL(client, g.DeviceId, otp),
+		})
+	}
 
 	result := <-client.DeviceEnrollment.PollEnroll(ctx, c8y.DeviceEnrollmentOption{
-		ExternalID:      g.DeviceId,
-		OneTimePassword: otp,
-		InitDelay:       2 * time.Second,
-		Interval:        5 * time.Second,
-		Timeout:         10 * time.Minute,
-		Banner: &c8y.DeviceEnrollmentBannerOptions{
-			Enable:     true,
-			ShowQRCode: true,
-			ShowURL:    true,
-		},
+		ExternalID:                g.DeviceId,
+		OneTimePassword:           otp,
+		InitDelay:                 g.InitDelay,
+		Interval:                  g.PollInterval,
+		Timeout:                   g.Timeout,
+		Banner:                    banner,
 		CertificateSigningRequest: csr,
-		OnProgressBefore: func() {
-			fmt.Fprintf(os.Stderr, "\rTrying to download certificate: ")
-		},
-		OnProgressError: func(r *c8y.Response, err error) {
-			fmt.Fprintf(os.Stderr, "WAITING (last statusCode=%s, time=%s)\n", r.Status(), time.Now().Format(time.RFC3339))
-		},
+		OnProgressBefore:          onProgressBefore,
+		OnProgressError:           onProgressError,
 	})
 	if result.Err != nil {
-		slog.Error("Failed to download the device certificate")
+		if g.Headless {
+			emitPollerEvent(pollerEvent{Event: "failed", ExternalID: g.DeviceId, Error: result.Err.Error()})
+		}
+		slog.Error("Failed to download the device certificate", "error", result.Err)
 		os.Exit(1)
 	}
 	slog.Info("Successfully download the device certificate")
@@ -97,6 +164,32 @@ func (g *CmdGroupEnrollmentPoller) Execute(args []string) error {
 
 	slog.Info(fmt.Sprintf("Certificate retrieval succeeded. Placed files '%s' and '%s' in current working directory.",
 		privateKeyFileName, certFileName))
+	if g.Headless {
+		emitPollerEvent(pollerEvent{
+			Event:           "enrolled",
+			ExternalID:      g.DeviceId,
+			CertificateFile: certFileName,
+			PrivateKeyFile:  privateKeyFileName,
+		})
+	}
 
 	return nil
 }
+
+// Returns the URL of the device registration page in the Device Management application, prefilled with
+// external ID and one-time password (same URL which is shown in the enrollment banner)
+func enrollmentURL(client *c8y.Client, externalID string, otp string) string {
+	return fmt.Sprintf("%s/apps/devicemanagement/index.html#/deviceregistration?externalId=%s&one-time-password=%s",
+		strings.TrimRight(client.BaseURL.String(), "/"), externalID, otp)
+}
+
+// Writes a poller event as single JSON line to stdout
+func emitPollerEvent(event pollerEvent) {
+	event.Time = time.Now().Format(time.RFC3339)
+	encoder := json.NewEncoder(os.Stdout)
+	// keep the URL readable ('&' instead of '\u0026')
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(event); err != nil {
+		slog.Error("Error while writing poller event", "error", err)
+	}
+}
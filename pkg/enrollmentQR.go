@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"path/filepath"
+	"strings"
+
+	"rsc.io/qr"
+)
+
+// Number of modules left blank around a QR code (as required by the QR specification)
+const qrQuietZone = 4
+
+// Writes the QR code of the text to file. The format is chosen by the file extension (.png or .svg).
+func writeQRCode(text string, fileName string) error {
+	code, err := qr.Encode(text, qr.M)
+	if err != nil {
+		return fmt.Errorf("error while encoding QR code: %w", err)
+	}
+	switch strings.ToLower(filepath.Ext(fileName)) {
+	case ".png":
+		return writeToFile(string(code.PNG()), fileName)
+	case ".svg":
+		size := code.Size + 2*qrQuietZone
+		svg := fmt.Sprintf(`<svg xmlns="http://www.w3.org/2000/svg" width="%dmm" height="%dmm" viewBox="0 0 %d %d" shape-rendering="crispEdges">`+"\n",
+			size, size, size, size)
+		svg += fmt.Sprintf(`<rect width="%d" height="%d" fill="#fff"/>`+"\n", size, size)
+		svg += fmt.Sprintf(`<path d="%s" fill="#000"/>`+"\n", qrCodeSVGPath(code, qrQuietZone, qrQuietZone))
+		svg += "</svg>\n"
+		return writeToFile(svg, fileName)
+	}
+	return errors.New("unsupported QR code file format (use .png or .svg): " + fileName)
+}
+
+// Writes a printable label (SVG, 62mm x 29mm) with the QR code of the enrollment URL next to device ID and
+// one-time password, so the device can be registered by scanning the label or by typing the values in.
+func writeEnrollmentLabel(fileName string, deviceID string, otp string, host string, enrollmentURL string) error {
+	if strings.ToLower(filepath.Ext(fileName)) != ".svg" {
+		return errors.New("unsupported label file format (use .svg): " + fileName)
+	}
+	code, err := qr.Encode(enrollmentURL, qr.M)
+	if err != nil {
+		return fmt.Errorf("error while encoding QR code: %w", err)
+	}
+
+	// all coordinates in mm, the QR code is scaled to the label height
+	const width, height, margin = 62.0, 29.0, 1.5
+	qrSize := height - 2*margin
+	module := qrSize / float64(code.Size+2*qrQuietZone)
+	textX := margin + qrSize + 1.0
+
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%gmm" height="%gmm" viewBox="0 0 %g %g">`+"\n", width, height, width, height)
+	fmt.Fprintf(&b, `<rect width="%g" height="%g" fill="#fff" stroke="#000" stroke-width="0.2"/>`+"\n", width, height)
+	fmt.Fprintf(&b, `<g transform="translate(%g %g) scale(%g)" shape-rendering="crispEdges">`+"\n", margin, margin, module)
+	fmt.Fprintf(&b, `<path d="%s" fill="#000"/>`+"\n", qrCodeSVGPath(code, qrQuietZone, qrQuietZone))
+	b.WriteString("</g>\n")
+	b.WriteString(`<g font-family="Helvetica, Arial, sans-serif" fill="#000">` + "\n")
+	fmt.Fprintf(&b, `<text x="%g" y="6" font-size="2.2">Device ID</text>`+"\n", textX)
+	fmt.Fprintf(&b, `<text x="%g" y="10" font-size="3.2" font-weight="bold">%s</text>`+"\n", textX, html.EscapeString(deviceID))
+	fmt.Fprintf(&b, `<text x="%g" y="15" font-size="2.2">One-time password</text>`+"\n", textX)
+	fmt.Fprintf(&b, `<text x="%g" y="18.5" font-size="2.4" font-family="monospace">%s</text>`+"\n", textX, html.EscapeString(otp))
+	fmt.Fprintf(&b, `<text x="%g" y="25" font-size="1.8">%s</text>`+"\n", textX, html.EscapeString(host))
+	b.WriteString("</g>\n</svg>\n")
+	return writeToFile(b.String(), fileName)
+}
+
+// Returns an SVG path drawing all black modules of the code as 1x1 squares, offset by x and y
+func qrCodeSVGPath(code *qr.Code, x int, y int) string {
+	var b strings.Builder
+	for row := 0; row < code.Size; row++ {
+		for col := 0; col < code.Size; col++ {
+			if code.Black(col, row) {
+				fmt.Fprintf(&b, "M%d %dh1v1h-1z", col+x, row+y)
+			}
+		}
+	}
+	return b.String()
+}
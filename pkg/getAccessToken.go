@@ -3,25 +3,41 @@ package main
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"log/slog"
+	"net/url"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/reubenmiller/go-c8y/pkg/c8y"
 )
 
 type CmdGroupGetAccessToken struct {
-	C8yHost         string `long:"cumulocity-host" description:"Provide platform endpoint, e.g. 'https://iot.eu-latest.cumulocity.com'" required:"true"`
-	CertificateFile string `long:"certificate" description:"File path to your certificate" required:"true"`
-	PrivateKeyFile  string `long:"private-key" description:"File path to your private key" required:"true"`
+	C8yHost         string        `long:"cumulocity-host" description:"Provide platform endpoint, e.g. 'https://iot.eu-latest.cumulocity.com'" required:"true"`
+	CertificateFile string        `long:"certificate" description:"File path to your certificate" required:"true"`
+	PrivateKeyFile  string        `long:"private-key" description:"File path to your private key" required:"true"`
+	Format          string        `long:"format" description:"Output format: 'text' (sentence with token), 'token' (token only), 'claims' (decoded token), 'export' (shell export lines) or 'dotenv'" choice:"text" choice:"token" choice:"claims" choice:"export" choice:"dotenv" default:"text"`
+	OutputFile      string        `long:"output" description:"Optional file path the output is written to instead of stdout, e.g. a dotenv file" required:"false"`
+	Cache           bool          `long:"cache" description:"Return a still valid token of an earlier call instead of requesting a new one (cached per host and certificate)"`
+	CacheDir        string        `long:"cache-dir" description:"Directory of the token cache. Optional (user cache directory when missing)" required:"false"`
+	RefreshBefore   time.Duration `long:"refresh-before" description:"Tokens expiring within this duration are not taken from the cache but refreshed" default:"5m"`
+	Watch           bool          `long:"watch" description:"Keep running and rewrite --output with a fresh token before the current one expires"`
 }
 
+// minimum time between two token requests in watch mode, also used as retry interval after errors
+const accessTokenWatchInterval = 30 * time.Second
+
 var getAccessTokenCmdName = "getAccessToken"
 var getAccessTokenCmdGroup CmdGroupGetAccessToken
 
 func (g *CmdGroupGetAccessToken) Execute(args []string) error {
-	slog.Info(fmt.Sprintf("Started %s with arguments: C8yHost=%s CertFile=%s PrivKeyFile=%s",
-		renewCertCmdName, g.C8yHost, g.CertificateFile, g.PrivateKeyFile))
+	slog.Info(fmt.Sprintf("Started %s with arguments: C8yHost=%s CertFile=%s PrivKeyFile=%s Format=%s OutputFile=%s Cache=%t CacheDir=%s RefreshBefore=%s Watch=%t",
+		getAccessTokenCmdName, g.C8yHost, g.CertificateFile, g.PrivateKeyFile, g.Format, g.OutputFile, g.Cache, g.CacheDir, g.RefreshBefore, g.Watch))
 
 	certPEM, err := readFromFile(g.CertificateFile)
 	if err != nil {
@@ -38,16 +54,145 @@ func (g *CmdGroupGetAccessToken) Execute(args []string) error {
 		slog.Error("Error while processing certificate and private key. Exiting now.", "error", err)
 		os.Exit(exitCodeGeneralProcessingError)
 	}
-	client := c8y.NewClient(nil, g.C8yHost, "", "", "", false)
-	token, tokenResp, err := client.DeviceEnrollment.RequestAccessToken(context.Background(), &clientCert, nil)
+	cache := newTokenCacheOrExit(g.Cache, g.CacheDir)
+	if g.Watch {
+		if len(g.OutputFile) == 0 {
+			slog.Error("Watch mode needs an output file (--output). Exiting now.")
+			os.Exit(exitCodePrerequisitesNotFulfilled)
+		}
+		g.watch(&clientCert, cache)
+		return nil
+	}
+
+	token, fromCache, err := obtainAccessToken(g.C8yHost, &clientCert, cache, g.RefreshBefore)
 	if err != nil {
-		slog.Error("Error while requesting access token", "error", err)
+		slog.Error("Error while requesting access token. Exiting now.", "error", err)
+		os.Exit(exitCodeGeneralProcessingError)
+	}
+	if fromCache {
+		slog.Info("Using cached access token", "expiresAt", token.ExpiresAt.Format(time.RFC3339))
 	}
-	if tokenResp.Response.StatusCode != 200 {
-		slog.Error("Unexpected response code while requesting first access token. Exiting now.", "expectedStatusCode", 200, "receivedStatusCode", tokenResp.Response.StatusCode)
+	if err := g.writeOutput(token); err != nil {
+		slog.Error("Error while writing access token. Exiting now.", "error", err, "fileName", g.OutputFile)
 		os.Exit(exitCodeGeneralProcessingError)
 	}
-	fmt.Println(fmt.Sprintf("Access Token obtained from %s:\n%s", client.BaseURL.Host, token.AccessToken))
+	return nil
+}
 
+// watch keeps the output file current until the process is stopped. Failed refreshes are retried, the last
+// written token is kept meanwhile.
+func (g *CmdGroupGetAccessToken) watch(clientCert *tls.Certificate, cache *tokenCache) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	for {
+		next := accessTokenWatchInterval
+		token, _, err := obtainAccessToken(g.C8yHost, clientCert, cache, g.RefreshBefore)
+		if err == nil {
+			err = g.writeOutput(token)
+		}
+		if err != nil {
+			slog.Error("Error while refreshing access token. Retrying.", "error", err, "retryIn", next)
+		} else if expiresAt, ok := token.expiresAt(); ok {
+			next = max(time.Until(expiresAt)-g.RefreshBefore, accessTokenWatchInterval)
+			slog.Info("Access token is current", "expiresAt", expiresAt.Format(time.RFC3339), "nextRefresh", next.Round(time.Second))
+		} else {
+			slog.Info("Access token is current, its expiry time is unknown", "nextRefresh", next)
+		}
+		select {
+		case <-ctx.Done():
+			slog.Info("Stopped watching access token")
+			return
+		case <-time.After(next):
+		}
+	}
+}
+
+// writeOutput prints the token in the requested format or places it in the output file (only readable by the owner)
+func (g *CmdGroupGetAccessToken) writeOutput(token *cachedToken) error {
+	output, err := formatAccessToken(g.Format, token.Host, token.AccessToken)
+	if err != nil {
+		return err
+	}
+	if len(g.OutputFile) == 0 {
+		fmt.Print(output)
+		return nil
+	}
+	if err := writeFileAtomically([]byte(output), g.OutputFile, 0600); err != nil {
+		return err
+	}
+	slog.Info("Placed access token", "fileName", g.OutputFile, "format", g.Format)
 	return nil
 }
+
+// decodeAccessToken returns the claims of a Cumulocity access token. The signature is not verified (the client
+// has no key for it), the claims are informational only.
+func decodeAccessToken(token string) (*c8y.CumulocityTokenClaim, error) {
+	claims := &c8y.CumulocityTokenClaim{}
+	if _, _, err := jwt.NewParser().ParseUnverified(token, claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// accessTokenExpiry returns the expiry time of the token
+func accessTokenExpiry(token string) (time.Time, error) {
+	claims, err := decodeAccessToken(token)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if claims.ExpiresAt == nil {
+		return time.Time{}, errors.New("access token has no expiry time")
+	}
+	return claims.ExpiresAt.Time, nil
+}
+
+// formatAccessToken renders the token in one of the formats of getAccessToken
+func formatAccessToken(format string, host string, token string) (string, error) {
+	switch format {
+	case "text":
+		hostName := host
+		if hostURL, err := url.Parse(host); err == nil && len(hostURL.Host) > 0 {
+			hostName = hostURL.Host
+		}
+		return fmt.Sprintf("Access Token obtained from %s:\n%s\n", hostName, token), nil
+	case "token":
+		return token + "\n", nil
+	}
+	claims, err := decodeAccessToken(token)
+	if err != nil {
+		return "", err
+	}
+	if format == "claims" {
+		expiresAt := formatNumericDate(claims.ExpiresAt)
+		if claims.ExpiresAt != nil {
+			expiresAt += fmt.Sprintf(" (in %s)", time.Until(claims.ExpiresAt.Time).Round(time.Second))
+		}
+		return fmt.Sprintf("Tenant: %s\nUser: %s\nIssuer: %s\nIssued at: %s\nExpires at: %s\n",
+			claims.Tenant, claims.User, claims.Issuer, formatNumericDate(claims.IssuedAt), expiresAt), nil
+	}
+
+	variables := [][2]string{
+		{"C8Y_HOST", host},
+		{"C8Y_TENANT", claims.Tenant},
+		{"C8Y_USER", claims.User},
+		{"C8Y_TOKEN", token},
+		{"C8Y_TOKEN_EXPIRES_AT", formatNumericDate(claims.ExpiresAt)},
+	}
+	var sb strings.Builder
+	for _, v := range variables {
+		if format == "export" {
+			// single quotes keep the value literal, embedded single quotes are closed, escaped and reopened
+			fmt.Fprintf(&sb, "export %s='%s'\n", v[0], strings.ReplaceAll(v[1], "'", `'\''`))
+		} else {
+			fmt.Fprintf(&sb, "%s=%s\n", v[0], v[1])
+		}
+	}
+	return sb.String(), nil
+}
+
+func formatNumericDate(date *jwt.NumericDate) string {
+	if date == nil {
+		return ""
+	}
+	return date.Time.Format(time.RFC3339)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+
+	"github.com/reubenmiller/go-c8y/pkg/c8y"
+)
+
+type CmdGroupListRegistrations struct {
+	C8yHost      string `long:"cumulocity-host" description:"Provide platform endpoint, e.g. 'https://iot.eu-latest.cumulocity.com'" required:"true"`
+	C8yTenantId  string `long:"cumulocity-tenant-id" description:"Provide platform tenand id, e.g. 't4009123'. Optional (resolved from host when missing)" required:"false"`
+	C8yUser      string `long:"cumulocity-user" description:"Provide your platform user, e.g. 'john.doe@example.org'" required:"true"`
+	C8yPassword  string `long:"cumulocity-password" description:"Provide your platform users password, e.g. 'aVerySecretPass1337'" required:"true"`
+	DeviceId     string `long:"device-id" description:"Show the state of this device only. Optional (all registration requests of the tenant when missing)"`
+	IdentityType string `long:"identity-type" description:"Type of the external ID the device managed object is registered with" default:"c8y_Serial"`
+}
+
+var listRegistrationsCmdName = "listRegistrations"
+var listRegistrationsCmdGroup CmdGroupListRegistrations
+
+const (
+	enrollmentStateNotRegistered  = "NOT_REGISTERED"
+	enrollmentStateWaitingDevice  = "WAITING_FOR_DEVICE"
+	enrollmentStateReadyToEnroll  = "READY_TO_ENROLL"
+	enrollmentStateEnrolled       = "ENROLLED"
+	enrollmentStateDeviceExists   = "DEVICE_EXISTS"
+	enrollmentStateUnknown        = "UNKNOWN"
+	registrationStateNotAvailable = "-"
+)
+
+// Server side state of a device: registration request, device user and managed object
+type registrationState struct {
+	DeviceID        string
+	RequestStatus   string
+	Enrollment      string
+	DeviceUser      string
+	ManagedObjectID string
+	ManagedObject   string
+}
+
+func (g *CmdGroupListRegistrations) Execute(args []string) error {
+	slog.Info(fmt.Sprintf("Started %s with arguments: C8yHost=%s C8yTenantId=%s C8yUser=%s C8yPassword=%s DeviceId=%s IdentityType=%s",
+		listRegistrationsCmdName, g.C8yHost, g.C8yTenantId, g.C8yUser, "{obfuscated}", g.DeviceId, g.IdentityType))
+
+	tenantID := resolveTenantIDOrExit(g.C8yHost, g.C8yTenantId, g.C8yUser, g.C8yPassword)
+	client := newC8yClient(g.C8yHost, tenantID, g.C8yUser, g.C8yPassword)
+
+	requests := map[string]*c8y.NewDeviceRequest{}
+	deviceIDs := []string{g.DeviceId}
+	if len(g.DeviceId) == 0 {
+		all, e := getRegistrationRequests(client)
+		if e != nil {
+			slog.Error("Error while retrieving registration requests. Exiting now.", "error", e)
+			os.Exit(exitCodeGeneralProcessingError)
+		}
+		deviceIDs = []string{}
+		for i := range all {
+			requests[all[i].ID] = &all[i]
+			deviceIDs = append(deviceIDs, all[i].ID)
+		}
+	}
+
+	failed := false
+	fmt.Printf("%-36s %-24s %-20s %-40s %s\n", "DEVICE ID", "REQUEST", "ENROLLMENT", "DEVICE USER", "MANAGED OBJECT")
+	for _, deviceID := range deviceIDs {
+		state, e := getRegistrationState(client, deviceID, requests[deviceID], g.IdentityType)
+		if e != nil {
+			slog.Error("Error while retrieving registration state", "error", e, "deviceID", deviceID)
+			failed = true
+		}
+		managedObject := state.ManagedObjectID
+		if len(state.ManagedObject) > 0 {
+			managedObject += " (" + state.ManagedObject + ")"
+		}
+		fmt.Printf("%-36s %-24s %-20s %-40s %s\n", state.DeviceID, state.RequestStatus, state.Enrollment, state.DeviceUser, managedObject)
+	}
+	if failed {
+		os.Exit(exitCodeGeneralProcessingError)
+	}
+	return nil
+}
+
+// Collects the server side state of a device. The registration request is requested if not provided.
+// Resources which don't exist are reported as "-", other errors are returned (with the state collected so far).
+func getRegistrationState(client *c8y.Client, deviceID string, request *c8y.NewDeviceRequest, identityType string) (registrationState, error) {
+	state := registrationState{
+		DeviceID:        deviceID,
+		RequestStatus:   registrationStateNotAvailable,
+		Enrollment:      enrollmentStateUnknown,
+		DeviceUser:      registrationStateNotAvailable,
+		ManagedObjectID: registrationStateNotAvailable,
+	}
+
+	if request == nil {
+		r, resp, err := client.DeviceCredentials.GetNewDeviceRequest(context.TODO(), deviceID)
+		switch {
+		case responseStatusCode(resp) == http.StatusNotFound:
+		case err != nil:
+			return state, fmt.Errorf("error while retrieving registration request: %w", err)
+		default:
+			request = r
+		}
+	}
+	if request != nil {
+		state.RequestStatus = request.Status
+	}
+
+	user, resp, err := client.User.GetUser(context.TODO(), deviceUserPrefix+deviceID)
+	switch {
+	case responseStatusCode(resp) == http.StatusNotFound:
+	case err != nil:
+		return state, fmt.Errorf("error while retrieving device user: %w", err)
+	default:
+		state.DeviceUser = user.Username
+		if !user.Enabled {
+			state.DeviceUser += " (disabled)"
+		}
+	}
+
+	identity, resp, err := client.Identity.GetExternalID(context.TODO(), identityType, deviceID)
+	switch {
+	case responseStatusCode(resp) == http.StatusNotFound:
+	case err != nil:
+		return state, fmt.Errorf("error while retrieving external id: %w", err)
+	default:
+		state.ManagedObjectID = identity.ManagedObject.ID
+		if mo, _, err := client.Inventory.GetManagedObject(context.TODO(), identity.ManagedObject.ID, nil); err == nil {
+			state.ManagedObject = mo.Name
+		}
+	}
+
+	switch {
+	case state.RequestStatus == c8y.NewDeviceRequestAccepted || state.DeviceUser != registrationStateNotAvailable:
+		state.Enrollment = enrollmentStateEnrolled
+	case state.RequestStatus == c8y.NewDeviceRequestPendingAcceptance:
+		state.Enrollment = enrollmentStateReadyToEnroll
+	case state.RequestStatus == c8y.NewDeviceRequestWaitingForConnection:
+		state.Enrollment = enrollmentStateWaitingDevice
+	case state.ManagedObjectID != registrationStateNotAvailable:
+		// managed object and external ID exist without registration request and device user (e.g. created by
+		// another registration method or left over by a decommissioning keeping the managed object)
+		state.Enrollment = enrollmentStateDeviceExists
+	default:
+		state.Enrollment = enrollmentStateNotRegistered
+	}
+	return state, nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/reubenmiller/go-c8y/pkg/c8y"
+)
+
+func TestGetRegistrationState(t *testing.T) {
+	const deviceID = "state-device"
+	request := func(status string) func(p *mockPlatform) {
+		return func(p *mockPlatform) {
+			p.registrations[deviceID] = &mockRegistration{ID: deviceID, Status: status, IdentityType: deviceIdentityType}
+		}
+	}
+	tests := []struct {
+		name           string
+		setup          func(p *mockPlatform)
+		wantEnrollment string
+		wantRequest    string
+		wantDeviceUser string
+	}{
+		{"unknown device", func(p *mockPlatform) {}, enrollmentStateNotRegistered, registrationStateNotAvailable, registrationStateNotAvailable},
+		{"request waiting for the device", request(c8y.NewDeviceRequestWaitingForConnection), enrollmentStateWaitingDevice, c8y.NewDeviceRequestWaitingForConnection, registrationStateNotAvailable},
+		{"request pending acceptance", request(c8y.NewDeviceRequestPendingAcceptance), enrollmentStateReadyToEnroll, c8y.NewDeviceRequestPendingAcceptance, registrationStateNotAvailable},
+		{"accepted request", request(c8y.NewDeviceRequestAccepted), enrollmentStateEnrolled, c8y.NewDeviceRequestAccepted, registrationStateNotAvailable},
+		{"connected device", func(p *mockPlatform) { p.connectDevice(deviceID) }, enrollmentStateEnrolled, registrationStateNotAvailable, deviceUserPrefix + deviceID},
+		{"disabled device user", func(p *mockPlatform) {
+			p.connectDevice(deviceID)
+			p.deviceUsers[deviceUserPrefix+deviceID].Enabled = false
+		}, enrollmentStateEnrolled, registrationStateNotAvailable, deviceUserPrefix + deviceID + " (disabled)"},
+		{"managed object without request and device user", func(p *mockPlatform) {
+			id := p.createManagedObject(map[string]any{"name": deviceID, "c8y_IsDevice": map[string]any{}})
+			p.identities[deviceIdentityType+"/"+deviceID] = id
+		}, enrollmentStateDeviceExists, registrationStateNotAvailable, registrationStateNotAvailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			platform := startTestPlatform(t)
+			platform.mu.Lock()
+			tt.setup(platform.mockPlatform)
+			platform.mu.Unlock()
+
+			state, err := getRegistrationState(platform.adminClient(), deviceID, nil, deviceIdentityType)
+			if err != nil {
+				t.Fatalf("getRegistrationState() error = %v", err)
+			}
+			if state.Enrollment != tt.wantEnrollment {
+				t.Errorf("enrollment = %s, want %s", state.Enrollment, tt.wantEnrollment)
+			}
+			if state.RequestStatus != tt.wantRequest {
+				t.Errorf("request status = %s, want %s", state.RequestStatus, tt.wantRequest)
+			}
+			if state.DeviceUser != tt.wantDeviceUser {
+				t.Errorf("device user = %s, want %s", state.DeviceUser, tt.wantDeviceUser)
+			}
+		})
+	}
+}
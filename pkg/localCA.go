@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"os"
+	"time"
+
+	"github.com/reubenmiller/go-c8y/pkg/certutil"
+)
+
+// Command group issuing device certificates from a local (intermediate) CA instead of the Cumulocity CA. The CA files
+// are shared by all sub commands.
+type CmdGroupLocalCA struct {
+	CaCertificate string `long:"ca-certificate" description:"File path of the local CA certificate (PEM)" default:"c8y-local-ca.pem"`
+	CaPrivateKey  string `long:"ca-private-key" description:"File path of the local CA private key (PEM)" default:"c8y-local-ca-private-key.pem"`
+
+	Init  CmdLocalCAInit  `command:"init" description:"Generate the local CA (self signed or as intermediate of a parent CA)"`
+	Issue CmdLocalCAIssue `command:"issue" description:"Issue a device certificate from the local CA (for a new key or a given CSR)"`
+}
+
+type CmdLocalCAInit struct {
+	CommonName        string        `long:"common-name" description:"Common name of the local CA" default:"Local Device CA"`
+	Validity          time.Duration `long:"validity" description:"Validity of the local CA certificate" default:"43800h"`
+	ParentCertificate string        `long:"parent-certificate" description:"Certificate of the parent CA (PEM). If provided, the local CA is an intermediate CA issued by it"`
+	ParentPrivateKey  string        `long:"parent-private-key" description:"Private key of the parent CA (PEM)"`
+	Force             bool          `long:"force" description:"Replace an existing local CA"`
+}
+
+type CmdLocalCAIssue struct {
+	DeviceId string        `long:"device-id" description:"Provide identifier of your device, e.g. 'kobu-edge-01'. Optional with --csr (common name of the CSR)"`
+	Csr      string        `long:"csr" description:"Sign this certificate signing request (PEM) instead of creating a new private key"`
+	Validity time.Duration `long:"validity" description:"Validity of the device certificate" default:"8760h"`
+}
+
+var localCACmdName = "localCA"
+var localCACmdGroup CmdGroupLocalCA
+
+func (g *CmdLocalCAInit) Execute(args []string) error {
+	ca := localCACmdGroup
+	slog.Info(fmt.Sprintf("Started %s init with arguments: CaCertificate=%s CaPrivateKey=%s CommonName=%s Validity=%s ParentCertificate=%s ParentPrivateKey=%s Force=%t",
+		localCACmdName, ca.CaCertificate, ca.CaPrivateKey, g.CommonName, g.Validity, g.ParentCertificate, g.ParentPrivateKey, g.Force))
+
+	if _, e := os.Stat(ca.CaCertificate); e == nil && !g.Force {
+		caCert, _, e := loadLocalCA(ca.CaCertificate, ca.CaPrivateKey)
+		if e != nil {
+			slog.Error("Error while loading existing local CA. Use --force to replace it. Exiting now.", "error", e)
+			os.Exit(exitCodePrerequisitesNotFulfilled)
+		}
+		slog.Info("Local CA exists already. Use --force to replace it.", "subject", caCert.Subject.String(),
+			"fingerprint", certificateFingerprint(caCert), "notAfter", caCert.NotAfter.Format(time.RFC3339))
+		return nil
+	}
+	if (len(g.ParentCertificate) == 0) != (len(g.ParentPrivateKey) == 0) {
+		slog.Error("Provide both --parent-certificate and --parent-private-key, or none of them. Exiting now.")
+		os.Exit(exitCodePrerequisitesNotFulfilled)
+	}
+
+	keyPem, e := certutil.MakeEllipticPrivateKeyPEM()
+	if e != nil {
+		slog.Error("Error while creating private key. Exiting now.", "error", e)
+		os.Exit(exitCodeGeneralProcessingError)
+	}
+	key, e := certutil.ParsePrivateKeyPEM(keyPem)
+	if e != nil {
+		slog.Error("Error while parsing private key. Exiting now.", "error", e)
+		os.Exit(exitCodeGeneralProcessingError)
+	}
+	signer := key.(crypto.Signer)
+
+	serial, e := randomSerialNumber()
+	if e != nil {
+		slog.Error("Error while creating serial number. Exiting now.", "error", e)
+		os.Exit(exitCodeGeneralProcessingError)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: g.CommonName, OrganizationalUnit: []string{"Device CA"}},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(g.Validity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	// self signed, unless a parent CA is given
+	parent, parentKey := template, signer
+	chainPEM := []byte{}
+	if len(g.ParentCertificate) > 0 {
+		if parent, parentKey, e = loadLocalCA(g.ParentCertificate, g.ParentPrivateKey); e != nil {
+			slog.Error("Error while loading parent CA. Exiting now.", "error", e)
+			os.Exit(exitCodePrerequisitesNotFulfilled)
+		}
+		if template.NotAfter.After(parent.NotAfter) {
+			slog.Warn("Validity exceeds the parent CA. Limiting it to the expiry of the parent CA.", "notAfter", parent.NotAfter.Format(time.RFC3339))
+			template.NotAfter = parent.NotAfter
+		}
+		chainPEM = certutil.MarshalCertificateToPEM(parent.Raw)
+	}
+	der, e := x509.CreateCertificate(rand.Reader, template, parent, signer.Public(), parentKey)
+	if e != nil {
+		slog.Error("Error while creating local CA certificate. Exiting now.", "error", e)
+		os.Exit(exitCodeGeneralProcessingError)
+	}
+	caCert, _ := x509.ParseCertificate(der)
+
+	for _, file := range []struct{ name, content string }{
+		{ca.CaPrivateKey, string(keyPem)},
+		{ca.CaCertificate, string(certutil.MarshalCertificateToPEM(der)) + string(chainPEM)},
+	} {
+		if e := writeToFile(file.content, file.name); e != nil {
+			slog.Error("Error while writing file. Exiting now.", "error", e, "fileName", file.name)
+			os.Exit(exitCodeGeneralProcessingError)
+		}
+	}
+	slog.Info(fmt.Sprintf("Created local CA. Placed files '%s' and '%s'.", ca.CaCertificate, ca.CaPrivateKey),
+		"subject", caCert.Subject.String(), "issuer", caCert.Issuer.String(), "fingerprint", certificateFingerprint(caCert),
+		"notAfter", caCert.NotAfter.Format(time.RFC3339))
+	slog.Info(fmt.Sprintf("Make the local CA a trusted certificate of your tenant: %s upload --certificate %s --private-key %s --auto-registration",
+		trustedCertCmdName, ca.CaCertificate, ca.CaPrivateKey))
+	return nil
+}
+
+func (g *CmdLocalCAIssue) Execute(args []string) error {
+	ca := localCACmdGroup
+	slog.Info(fmt.Sprintf("Started %s issue with arguments: CaCertificate=%s CaPrivateKey=%s DeviceId=%s Csr=%s Validity=%s",
+		localCACmdName, ca.CaCertificate, ca.CaPrivateKey, g.DeviceId, g.Csr, g.Validity))
+
+	caCert, caKey, e := loadLocalCA(ca.CaCertificate, ca.CaPrivateKey)
+	if e != nil {
+		slog.Error("Error while loading local CA. Create it with '"+localCACmdName+" init'. Exiting now.", "error", e)
+		os.Exit(exitCodePrerequisitesNotFulfilled)
+	}
+
+	deviceID := g.DeviceId
+	var keyPem []byte
+	var csr *x509.CertificateRequest
+	if len(g.Csr) > 0 {
+		if csr, e = readCertificateSigningRequest(g.Csr); e != nil {
+			slog.Error("Error while reading certificate signing request. Exiting now.", "error", e, "fileName", g.Csr)
+			os.Exit(exitCodePrerequisitesNotFulfilled)
+		}
+		if len(deviceID) > 0 && deviceID != csr.Subject.CommonName {
+			slog.Error("Device ID does not match the common name of the CSR. Exiting now.", "deviceID", deviceID, "commonName", csr.Subject.CommonName)
+			os.Exit(exitCodePrerequisitesNotFulfilled)
+		}
+		deviceID = csr.Subject.CommonName
+	} else {
+		if len(deviceID) == 0 {
+			slog.Error("Provide --device-id or --csr. Exiting now.")
+			os.Exit(exitCodePrerequisitesNotFulfilled)
+		}
+		slog.Info("Creating private key for device-id", "deviceID", deviceID)
+		if keyPem, e = certutil.MakeEllipticPrivateKeyPEM(); e != nil {
+			slog.Error("Error wile creating private key. Exiting now.", "error", e, "deviceID", deviceID)
+			os.Exit(exitCodeGeneralProcessingError)
+		}
+		key, e := certutil.ParsePrivateKeyPEM(keyPem)
+		if e != nil {
+			slog.Error("Error wile parsing private key. Exiting now.", "error", e, "deviceID", deviceID)
+			os.Exit(exitCodeGeneralProcessingError)
+		}
+		slog.Info("Creating certificate signing request", "deviceID", deviceID)
+		if csr, e = createDeviceCSR(deviceID, key); e != nil {
+			slog.Error("Error while creating Certificate signing request. Exiting now.", "error", e)
+			os.Exit(exitCodeGeneralProcessingError)
+		}
+	}
+	if len(deviceID) == 0 {
+		slog.Error("Certificate signing request has no common name (device ID). Exiting now.")
+		os.Exit(exitCodePrerequisitesNotFulfilled)
+	}
+
+	slog.Info("Issuing device certificate", "deviceID", deviceID, "issuer", caCert.Subject.String())
+	cert, e := signDeviceCSR(caCert, caKey, csr, g.Validity)
+	if e != nil {
+		slog.Error("Error while issuing device certificate. Exiting now.", "error", e, "deviceID", deviceID)
+		os.Exit(exitCodeGeneralProcessingError)
+	}
+	certPEM := certutil.MarshalCertificateToPEM(cert.Raw)
+	// devices send the intermediate CA along, so the tenant may trust the local CA or its parent
+	if !isSelfSigned(caCert) {
+		certPEM = append(certPEM, certutil.MarshalCertificateToPEM(caCert.Raw)...)
+	}
+
+	privateKeyFileName := fmt.Sprintf(fileNameTemplatePrivateKey, deviceID)
+	certFileName := fmt.Sprintf(fileNameTemplateCertificate, deviceID)
+	placed := fmt.Sprintf("file '%s'", certFileName)
+	if keyPem != nil {
+		if e := writeToFile(string(keyPem), privateKeyFileName); e != nil {
+			slog.Error("Error while writing file. Exiting now.", "error", e, "fileName", privateKeyFileName)
+			os.Exit(exitCodeGeneralProcessingError)
+		}
+		placed = fmt.Sprintf("files '%s' and '%s'", privateKeyFileName, certFileName)
+	}
+	if e := writeToFile(string(certPEM), certFileName); e != nil {
+		slog.Error("Error while writing file. Exiting now.", "error", e, "fileName", certFileName)
+		os.Exit(exitCodeGeneralProcessingError)
+	}
+	slog.Info("Certificate issued. Placed "+placed+" in current working directory.",
+		"serial", serialToHex(cert.SerialNumber), "notAfter", cert.NotAfter.Format(time.RFC3339))
+	return nil
+}
+
+// Loads a CA certificate and its private key and checks that they belong together
+func loadLocalCA(certificateFile string, privateKeyFile string) (*x509.Certificate, crypto.Signer, error) {
+	cert, err := readCertificateFile(certificateFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error while reading CA certificate %s: %w", certificateFile, err)
+	}
+	if !cert.IsCA {
+		return nil, nil, fmt.Errorf("certificate %s is not a CA certificate", certificateFile)
+	}
+	key, err := readSigningKey(privateKeyFile, cert)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error while reading CA private key %s: %w", privateKeyFile, err)
+	}
+	return cert, key, nil
+}
+
+// Issues a client certificate for the CSR of a device. The validity is limited to the one of the CA.
+func signDeviceCSR(caCert *x509.Certificate, caKey crypto.Signer, csr *x509.CertificateRequest, validity time.Duration) (*x509.Certificate, error) {
+	serial, err := randomSerialNumber()
+	if err != nil {
+		return nil, err
+	}
+	notAfter := time.Now().Add(validity)
+	if notAfter.After(caCert.NotAfter) {
+		slog.Warn("Validity exceeds the CA. Limiting it to the expiry of the CA.", "notAfter", caCert.NotAfter.Format(time.RFC3339))
+		notAfter = caCert.NotAfter
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      csr.Subject,
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, csr.PublicKey, caKey)
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(der)
+}
+
+func readCertificateSigningRequest(fileName string) (*x509.CertificateRequest, error) {
+	csrPEM, err := readFromFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	return parseCertificateSigningRequestPEM(csrPEM)
+}
+
+// Parses a PEM encoded certificate signing request and checks its signature
+func parseCertificateSigningRequestPEM(csrPEM []byte) (*x509.CertificateRequest, error) {
+	block, _ := pem.Decode(csrPEM)
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		return nil, errors.New("file does not contain a PEM encoded certificate request")
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	return csr, csr.CheckSignature()
+}
+
+// Returns a random positive serial number of 128 bit
+func randomSerialNumber() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+func isSelfSigned(cert *x509.Certificate) bool {
+	return bytes.Equal(cert.RawIssuer, cert.RawSubject) && cert.CheckSignatureFrom(cert) == nil
+}
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"log/slog"
 	"os"
+	"time"
 
 	"github.com/jessevdk/go-flags"
 )
@@ -17,30 +19,117 @@ func init() {
 		"This command will create private key, CSR and starts polling for device credentials. Once a user does the registration, the certificate will be downloaded",
 		&regUsingPollerCmdGroup)
 
+	parser.AddCommand(approveRegistrationCmdName,
+		"Approve device registrations",
+		"This command creates (and accepts) the registration request a polling device is waiting for, lists pending registration requests and accepts selected ones (using provided user credentials)",
+		&approveRegistrationCmdGroup)
+
+	parser.AddCommand(listRegistrationsCmdName,
+		"List device registrations",
+		"This command shows registration request, enrollment state, device user and managed object of a device or of all registration requests in the tenant (using provided user credentials)",
+		&listRegistrationsCmdGroup)
+
+	parser.AddCommand(decommissionCmdName,
+		"Decommission a device",
+		"This command removes the registration request and certificate based credentials of a device and optionally its managed object and local key/certificate files (using provided user credentials)",
+		&decommissionCmdGroup)
+
+	parser.AddCommand(offlineEnrollmentCmdName,
+		"Register a device without platform access",
+		"This command group splits the enrollment for air-gapped devices: the device writes a signed request bundle (key, CSR, one-time password), a system with platform access registers and enrolls it (using provided user credentials) and the device imports the response bundle",
+		&offlineEnrollmentCmdGroup)
+
 	parser.AddCommand(renewCertCmdName,
 		"Renew certificate",
 		"This command uses an existing certifidate and requests/downloads a new one",
 		&renewCertCmdGroup)
 
+	parser.AddCommand(agentCmdName,
+		"Run certificate agent",
+		"This command authenticates with the device certificate, polls pending c8y_RenewCertificate operations of the device and renews the certificate (optionally with a new private key) when one is received. The operation status is updated to EXECUTING and SUCCESSFUL or FAILED",
+		&agentCmdGroup)
+
+	parser.AddCommand(revokeCertificateCmdName,
+		"Revoke certificate",
+		"This command adds a device certificate to the certificate revocation list of the tenant (using provided user credentials) and verifies that access tokens are rejected afterwards",
+		&revokeCertificateCmdGroup)
+
+	parser.AddCommand(tenantCACmdName,
+		"Manage tenant CA",
+		"This command group creates, shows, downloads and renews the certificate authority of the tenant (using provided user credentials)",
+		&tenantCACmdGroup)
+
+	parser.AddCommand(trustedCertCmdName,
+		"Manage trusted certificates",
+		"This command group uploads CA certificates (e.g. of a corporate PKI) to the trusted certificates of the tenant, proves possession of their keys, enables auto registration, lists and deletes them (using provided user credentials)",
+		&trustedCertCmdGroup)
+
+	parser.AddCommand(localCACmdName,
+		"Issue certificates from local CA",
+		"This command group generates (or loads) a local intermediate CA and issues device certificates from it, with the same key/CSR pipeline and file layout as the enrollment commands. No platform access needed",
+		&localCACmdGroup)
+
 	parser.AddCommand(getAccessTokenCmdName,
 		"Get Access Token",
 		"This command accepts private key and certificate and requests an Access Token via Cumulocitys HTTP/REST API",
 		&getAccessTokenCmdGroup)
 
+	parser.AddCommand(requestCmdName,
+		"Send API request as device",
+		"This command accepts private key and certificate, requests an Access Token and sends a REST request to the tenant with the identity of the device (curl-like)",
+		&requestCmdGroup)
+
+	parser.AddCommand(whoamiCmdName,
+		"Show identity of certificate",
+		"This command accepts private key and certificate, requests an Access Token and reports device user, tenant, device managed object and its external IDs",
+		&whoamiCmdGroup)
+
 	parser.AddCommand(verifyCertificateCmdName,
 		"Verify certificate",
-		"This command accepts private key and certificate and tests if it's valid (by requesting access token via HTTP)",
+		"This command accepts private key and certificate and tests if it's valid (by requesting access token via HTTP or connecting via MQTT)",
 		&verifyCertificateCmdGroup)
 
+	parser.AddCommand(doctorCmdName,
+		"Check prerequisites",
+		"This command runs all prerequisite checks for certificate enrollment (connectivity, tenant, user roles, CA feature and certificate, clock skew, output location) and reports each as pass/fail",
+		&doctorCmdGroup)
+
+	parser.AddCommand(serveMockCmdName,
+		"Serve mock platform",
+		"This command starts a local mock of the Cumulocity CA endpoints (with mTLS) which issues real certificates from a generated CA. Useful for integration tests without a live tenant",
+		&serveMockCmdGroup)
+
 	parser.AddCommand(versionCmdName,
 		"Version",
 		"This command tells about the current tool version",
 		&versionCmdGroup)
 }
 
-var parser = flags.NewParser(nil, flags.Default)
+// Options which are accepted by all commands
+type GlobalOptions struct {
+	Record string `long:"record" description:"Record all HTTP exchanges (with credentials, tokens and keys redacted) into the given cassette file" required:"false"`
+	Replay string `long:"replay" description:"Serve HTTP responses from the given cassette file instead of contacting the platform" required:"false"`
+
+	RetryMaxAttempts  int           `long:"retry-max-attempts" description:"Maximum attempts for enrollment, re-enrollment, access token and bulk registration requests" default:"5"`
+	RetryInitialDelay time.Duration `long:"retry-initial-delay" description:"Delay before the first retry, doubled for every further retry (with jitter)" default:"1s"`
+	RetryMaxDelay     time.Duration `long:"retry-max-delay" description:"Maximum delay between two retries (0 for no limit)" default:"30s"`
+	RetryDeadline     time.Duration `long:"retry-deadline" description:"Total time after which no further retry is started" default:"2m"`
+}
+
+var globalOptions GlobalOptions
+var parser = flags.NewParser(&globalOptions, flags.Default)
 
 func main() {
+	parser.CommandHandler = func(command flags.Commander, args []string) error {
+		if err := activateCassette(globalOptions.Record, globalOptions.Replay); err != nil {
+			slog.Error("Error while setting up HTTP record/replay. Exiting now.", "error", err)
+			os.Exit(exitCodePrerequisitesNotFulfilled)
+		}
+		if command == nil {
+			return nil
+		}
+		return command.Execute(args)
+	}
 	if _, err := parser.Parse(); err != nil {
 		switch flagsErr := err.(type) {
 		case flags.ErrorType:
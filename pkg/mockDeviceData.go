@@ -0,0 +1,258 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/reubenmiller/go-c8y/pkg/c8y"
+)
+
+// Event, alarm and operation endpoints of the mock platform, used by devices to report about their certificate and
+// to receive renewal requests. Only the fields needed by the commands are validated, all other fragments are stored
+// as sent.
+
+func (p *mockPlatform) registerDeviceDataHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("GET /event/events", p.requireUserOrDevice(p.handleListEvents))
+	mux.HandleFunc("POST /event/events", p.requireUserOrDevice(p.handleCreateEvent))
+	mux.HandleFunc("GET /alarm/alarms", p.requireUserOrDevice(p.handleListAlarms))
+	mux.HandleFunc("POST /alarm/alarms", p.requireUserOrDevice(p.handleCreateAlarm))
+	mux.HandleFunc("PUT /alarm/alarms/{id}", p.requireUserOrDevice(p.handleUpdateAlarm))
+	mux.HandleFunc("GET /devicecontrol/operations", p.requireUserOrDevice(p.handleListOperations))
+	mux.HandleFunc("POST /devicecontrol/operations", p.requireUser(p.handleCreateOperation))
+	mux.HandleFunc("GET /devicecontrol/operations/{id}", p.requireUserOrDevice(p.handleGetOperation))
+	mux.HandleFunc("PUT /devicecontrol/operations/{id}", p.requireUserOrDevice(p.handleUpdateOperation))
+}
+
+// sourceID returns the id of the "source" fragment of events and alarms
+func sourceID(item map[string]any) string {
+	source, _ := item["source"].(map[string]any)
+	id, _ := source["id"].(string)
+	return id
+}
+
+// mockDeviceDataPage filters items by the query parameters source, type and status (comma separated), orders them
+// by id (newest first, like the platform does for events and alarms) and pages them
+func mockDeviceDataPage(r *http.Request, items map[string]map[string]any) []map[string]any {
+	query := r.URL.Query()
+	filtered := []map[string]any{}
+	for _, item := range items {
+		if source := query.Get("source"); len(source) > 0 && sourceID(item) != source {
+			continue
+		}
+		if itemType := query.Get("type"); len(itemType) > 0 && item["type"] != itemType {
+			continue
+		}
+		itemStatus, _ := item["status"].(string)
+		if status := query.Get("status"); len(status) > 0 && !slices.Contains(strings.Split(status, ","), itemStatus) {
+			continue
+		}
+		filtered = append(filtered, maps.Clone(item))
+	}
+	return mockSortedPage(r, filtered, true)
+}
+
+// mockSortedPage orders items by id and pages them
+func mockSortedPage(r *http.Request, items []map[string]any, newestFirst bool) []map[string]any {
+	slices.SortFunc(items, func(a, b map[string]any) int {
+		idA, _ := strconv.Atoi(a["id"].(string))
+		idB, _ := strconv.Atoi(b["id"].(string))
+		if newestFirst {
+			return idB - idA
+		}
+		return idA - idB
+	})
+	return mockPage(r, items)
+}
+
+func (p *mockPlatform) handleListEvents(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	writeMockJSON(w, http.StatusOK, map[string]any{"events": mockDeviceDataPage(r, p.events)})
+}
+
+func (p *mockPlatform) handleCreateEvent(w http.ResponseWriter, r *http.Request) {
+	event := map[string]any{}
+	if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+		writeMockError(w, http.StatusUnprocessableEntity, "event/Invalid", err.Error())
+		return
+	}
+	if _, ok := event["type"].(string); !ok {
+		writeMockError(w, http.StatusUnprocessableEntity, "event/Invalid", "Event needs a type")
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.managedObjects[sourceID(event)]; !ok {
+		writeMockError(w, http.StatusUnprocessableEntity, "event/Invalid", "Source "+sourceID(event)+" not found")
+		return
+	}
+	p.nextID++
+	id := strconv.FormatInt(p.nextID, 10)
+	event["id"] = id
+	event["creationTime"] = time.Now().Format(time.RFC3339)
+	event["self"] = fmt.Sprintf("https://%s/event/events/%s", r.Host, id)
+	p.events[id] = event
+	slog.Info("Mock platform created event", "id", id, "type", event["type"], "source", sourceID(event), "text", event["text"])
+	writeMockJSON(w, http.StatusCreated, event)
+}
+
+func (p *mockPlatform) handleListAlarms(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	writeMockJSON(w, http.StatusOK, map[string]any{"alarms": mockDeviceDataPage(r, p.alarms)})
+}
+
+// handleCreateAlarm de-duplicates like the platform: an alarm of the same source and type which is not cleared
+// yet is returned with increased count instead of creating a new one
+func (p *mockPlatform) handleCreateAlarm(w http.ResponseWriter, r *http.Request) {
+	alarm := map[string]any{}
+	if err := json.NewDecoder(r.Body).Decode(&alarm); err != nil {
+		writeMockError(w, http.StatusUnprocessableEntity, "alarm/Invalid", err.Error())
+		return
+	}
+	if _, ok := alarm["type"].(string); !ok {
+		writeMockError(w, http.StatusUnprocessableEntity, "alarm/Invalid", "Alarm needs a type")
+		return
+	}
+	if _, ok := alarm["severity"].(string); !ok {
+		writeMockError(w, http.StatusUnprocessableEntity, "alarm/Invalid", "Alarm needs a severity")
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.managedObjects[sourceID(alarm)]; !ok {
+		writeMockError(w, http.StatusUnprocessableEntity, "alarm/Invalid", "Source "+sourceID(alarm)+" not found")
+		return
+	}
+	for _, existing := range p.alarms {
+		if sourceID(existing) == sourceID(alarm) && existing["type"] == alarm["type"] && existing["status"] != c8y.AlarmStatusCleared {
+			existing["count"] = existing["count"].(int) + 1
+			existing["time"] = alarm["time"]
+			slog.Info("Mock platform de-duplicated alarm", "id", existing["id"], "type", existing["type"], "count", existing["count"])
+			writeMockJSON(w, http.StatusCreated, existing)
+			return
+		}
+	}
+	p.nextID++
+	id := strconv.FormatInt(p.nextID, 10)
+	alarm["id"] = id
+	if _, ok := alarm["status"].(string); !ok {
+		alarm["status"] = c8y.AlarmStatusActive
+	}
+	alarm["count"] = 1
+	alarm["creationTime"] = time.Now().Format(time.RFC3339)
+	alarm["self"] = fmt.Sprintf("https://%s/alarm/alarms/%s", r.Host, id)
+	p.alarms[id] = alarm
+	slog.Info("Mock platform raised alarm", "id", id, "type", alarm["type"], "severity", alarm["severity"], "source", sourceID(alarm), "text", alarm["text"])
+	writeMockJSON(w, http.StatusCreated, alarm)
+}
+
+// handleUpdateAlarm changes status, severity and text of an alarm
+func (p *mockPlatform) handleUpdateAlarm(w http.ResponseWriter, r *http.Request) {
+	update := map[string]any{}
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		writeMockError(w, http.StatusUnprocessableEntity, "alarm/Invalid", err.Error())
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	alarm, ok := p.alarms[r.PathValue("id")]
+	if !ok {
+		writeMockError(w, http.StatusNotFound, "alarm/Not Found", "Alarm "+r.PathValue("id")+" not found")
+		return
+	}
+	for _, key := range []string{"status", "severity", "text"} {
+		if value, ok := update[key]; ok {
+			alarm[key] = value
+		}
+	}
+	slog.Info("Mock platform updated alarm", "id", alarm["id"], "type", alarm["type"], "status", alarm["status"])
+	writeMockJSON(w, http.StatusOK, alarm)
+}
+
+// handleListOperations supports the query parameters deviceId, status and fragmentType. Like the platform it returns
+// the oldest operations first, revert=true returns the newest first.
+func (p *mockPlatform) handleListOperations(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filtered := []map[string]any{}
+	p.mu.Lock()
+	for _, operation := range p.operations {
+		if deviceID := query.Get("deviceId"); len(deviceID) > 0 && operation["deviceId"] != deviceID {
+			continue
+		}
+		if status := query.Get("status"); len(status) > 0 && operation["status"] != status {
+			continue
+		}
+		if fragmentType := query.Get("fragmentType"); len(fragmentType) > 0 && operation[fragmentType] == nil {
+			continue
+		}
+		filtered = append(filtered, maps.Clone(operation))
+	}
+	p.mu.Unlock()
+	writeMockJSON(w, http.StatusOK, map[string]any{"operations": mockSortedPage(r, filtered, query.Get("revert") == "true")})
+}
+
+func (p *mockPlatform) handleCreateOperation(w http.ResponseWriter, r *http.Request) {
+	operation := map[string]any{}
+	if err := json.NewDecoder(r.Body).Decode(&operation); err != nil {
+		writeMockError(w, http.StatusUnprocessableEntity, "devicecontrol/Invalid", err.Error())
+		return
+	}
+	deviceID, _ := operation["deviceId"].(string)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.managedObjects[deviceID]; !ok {
+		writeMockError(w, http.StatusUnprocessableEntity, "devicecontrol/Invalid", "Device "+deviceID+" not found")
+		return
+	}
+	p.nextID++
+	id := strconv.FormatInt(p.nextID, 10)
+	operation["id"] = id
+	operation["status"] = c8y.OperationStatusPending
+	operation["creationTime"] = time.Now().Format(time.RFC3339)
+	operation["self"] = fmt.Sprintf("https://%s/devicecontrol/operations/%s", r.Host, id)
+	p.operations[id] = operation
+	slog.Info("Mock platform created operation", "id", id, "deviceId", deviceID, "description", operation["description"])
+	writeMockJSON(w, http.StatusCreated, operation)
+}
+
+func (p *mockPlatform) handleGetOperation(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	operation, ok := p.operations[r.PathValue("id")]
+	if !ok {
+		writeMockError(w, http.StatusNotFound, "devicecontrol/Not Found", "Operation "+r.PathValue("id")+" not found")
+		return
+	}
+	writeMockJSON(w, http.StatusOK, operation)
+}
+
+// handleUpdateOperation changes status and failure reason of an operation
+func (p *mockPlatform) handleUpdateOperation(w http.ResponseWriter, r *http.Request) {
+	update := map[string]any{}
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		writeMockError(w, http.StatusUnprocessableEntity, "devicecontrol/Invalid", err.Error())
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	operation, ok := p.operations[r.PathValue("id")]
+	if !ok {
+		writeMockError(w, http.StatusNotFound, "devicecontrol/Not Found", "Operation "+r.PathValue("id")+" not found")
+		return
+	}
+	for _, key := range []string{"status", "failureReason"} {
+		if value, ok := update[key]; ok {
+			operation[key] = value
+		}
+	}
+	slog.Info("Mock platform updated operation", "id", operation["id"], "status", operation["status"], "failureReason", operation["failureReason"])
+	writeMockJSON(w, http.StatusOK, operation)
+}
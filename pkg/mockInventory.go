@@ -0,0 +1,268 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Inventory, identity and device user endpoints of the mock platform. Devices are "connected" when they
+// request their first access token: the device user is created then, and the managed object plus external
+// ID are created as described by the registration request (bulk registration columns NAME, TYPE, IDTYPE).
+
+// mockDeviceUser represents the user Cumulocity creates for a certificate based device
+type mockDeviceUser struct {
+	ID           string `json:"id"`
+	UserName     string `json:"userName"`
+	Enabled      bool   `json:"enabled"`
+	CreationTime string `json:"creationTime,omitempty"`
+	Self         string `json:"self,omitempty"`
+}
+
+func (p *mockPlatform) registerInventoryHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("GET /identity/externalIds/{type}/{externalId}", p.requireUserOrDevice(p.handleGetExternalID))
+	mux.HandleFunc("DELETE /identity/externalIds/{type}/{externalId}", p.requireUser(p.handleDeleteExternalID))
+	mux.HandleFunc("GET /identity/globalIds/{id}/externalIds", p.requireUserOrDevice(p.handleListExternalIDs))
+	mux.HandleFunc("GET /inventory/managedObjects", p.requireUserOrDevice(p.handleListManagedObjects))
+	mux.HandleFunc("POST /inventory/managedObjects", p.requireUserOrDevice(p.handleCreateManagedObject))
+	mux.HandleFunc("GET /inventory/managedObjects/{id}", p.requireUserOrDevice(p.handleGetManagedObject))
+	mux.HandleFunc("PUT /inventory/managedObjects/{id}", p.requireUserOrDevice(p.handleUpdateManagedObject))
+	mux.HandleFunc("DELETE /inventory/managedObjects/{id}", p.requireUser(p.handleDeleteManagedObject))
+	mux.HandleFunc("GET /user/{tenant}/users/{userName}", p.requireUser(p.handleGetDeviceUser))
+	mux.HandleFunc("DELETE /user/{tenant}/users/{userName}", p.requireUser(p.handleDeleteDeviceUser))
+}
+
+// requireUserOrDevice passes requests authenticated by the platform user or by a device access token
+func (p *mockPlatform) requireUserOrDevice(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+			if _, err := p.parseDeviceToken(r); err != nil {
+				writeMockError(w, http.StatusUnauthorized, "security/Unauthorized", "Invalid access token: "+err.Error())
+				return
+			}
+			next(w, r)
+			return
+		}
+		p.requireUser(next)(w, r)
+	}
+}
+
+// connectDevice creates device user, managed object and external ID of a device (if missing).
+// The caller must hold the lock.
+func (p *mockPlatform) connectDevice(externalID string) {
+	userName := deviceUserPrefix + externalID
+	if _, exists := p.deviceUsers[userName]; !exists {
+		p.deviceUsers[userName] = &mockDeviceUser{
+			ID:           userName,
+			UserName:     userName,
+			Enabled:      true,
+			CreationTime: time.Now().Format(time.RFC3339),
+		}
+	}
+
+	name, deviceType, identityType, agent := externalID, "c8y_Device", deviceIdentityType, false
+	if reg, ok := p.registrations[externalID]; ok {
+		name, deviceType, identityType, agent = reg.Name, reg.Type, reg.IdentityType, reg.Agent
+	}
+	if _, exists := p.identities[identityType+"/"+externalID]; exists {
+		return
+	}
+	mo := map[string]any{
+		"name":         name,
+		"type":         deviceType,
+		"owner":        userName,
+		"c8y_IsDevice": map[string]any{},
+	}
+	if agent {
+		mo["com_cumulocity_model_Agent"] = map[string]any{}
+	}
+	id := p.createManagedObject(mo)
+	p.identities[identityType+"/"+externalID] = id
+}
+
+// createManagedObject stores a managed object and returns its id. The caller must hold the lock.
+func (p *mockPlatform) createManagedObject(mo map[string]any) string {
+	p.nextID++
+	id := strconv.FormatInt(p.nextID, 10)
+	now := time.Now().Format(time.RFC3339)
+	mo["id"] = id
+	mo["creationTime"] = now
+	mo["lastUpdated"] = now
+	p.managedObjects[id] = mo
+	return id
+}
+
+func (p *mockPlatform) identity(r *http.Request, identityType string, externalID string, id string) map[string]any {
+	return map[string]any{
+		"externalId": externalID,
+		"type":       identityType,
+		"self":       fmt.Sprintf("https://%s/identity/externalIds/%s/%s", r.Host, identityType, externalID),
+		"managedObject": map[string]string{
+			"id":   id,
+			"self": fmt.Sprintf("https://%s/inventory/managedObjects/%s", r.Host, id),
+		},
+	}
+}
+
+func (p *mockPlatform) handleGetExternalID(w http.ResponseWriter, r *http.Request) {
+	identityType, externalID := r.PathValue("type"), r.PathValue("externalId")
+	p.mu.Lock()
+	id, ok := p.identities[identityType+"/"+externalID]
+	p.mu.Unlock()
+	if !ok {
+		writeMockError(w, http.StatusNotFound, "identity/Not Found", fmt.Sprintf("External id not found; external id = ID [type=%s, value=%s]", identityType, externalID))
+		return
+	}
+	writeMockJSON(w, http.StatusOK, p.identity(r, identityType, externalID, id))
+}
+
+func (p *mockPlatform) handleDeleteExternalID(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("type") + "/" + r.PathValue("externalId")
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.identities[key]; !ok {
+		writeMockError(w, http.StatusNotFound, "identity/Not Found", "External id not found: "+key)
+		return
+	}
+	delete(p.identities, key)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (p *mockPlatform) handleListExternalIDs(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	items := []map[string]any{}
+	p.mu.Lock()
+	for key, moID := range p.identities {
+		if moID == id {
+			identityType, externalID, _ := strings.Cut(key, "/")
+			items = append(items, p.identity(r, identityType, externalID, id))
+		}
+	}
+	p.mu.Unlock()
+	writeMockJSON(w, http.StatusOK, map[string]any{"externalIds": items})
+}
+
+// handleListManagedObjects supports the query parameters owner, type and fragmentType (ordered by id)
+func (p *mockPlatform) handleListManagedObjects(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	items := []map[string]any{}
+	p.mu.Lock()
+	for _, mo := range p.managedObjects {
+		if owner := query.Get("owner"); len(owner) > 0 && mo["owner"] != owner {
+			continue
+		}
+		if moType := query.Get("type"); len(moType) > 0 && mo["type"] != moType {
+			continue
+		}
+		if fragmentType := query.Get("fragmentType"); len(fragmentType) > 0 && mo[fragmentType] == nil {
+			continue
+		}
+		items = append(items, p.withManagedObjectSelf(r, mo))
+	}
+	p.mu.Unlock()
+	slices.SortFunc(items, func(a, b map[string]any) int {
+		idA, _ := strconv.Atoi(a["id"].(string))
+		idB, _ := strconv.Atoi(b["id"].(string))
+		return idA - idB
+	})
+	writeMockJSON(w, http.StatusOK, map[string]any{"managedObjects": mockPage(r, items)})
+}
+
+func (p *mockPlatform) handleCreateManagedObject(w http.ResponseWriter, r *http.Request) {
+	mo := map[string]any{}
+	if err := json.NewDecoder(r.Body).Decode(&mo); err != nil {
+		writeMockError(w, http.StatusUnprocessableEntity, "inventory/Invalid", err.Error())
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	id := p.createManagedObject(mo)
+	writeMockJSON(w, http.StatusCreated, p.withManagedObjectSelf(r, p.managedObjects[id]))
+}
+
+func (p *mockPlatform) handleGetManagedObject(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	mo, ok := p.managedObjects[r.PathValue("id")]
+	if !ok {
+		writeMockError(w, http.StatusNotFound, "inventory/Not Found", "Finding device data from database failed : No managedObject for id '"+r.PathValue("id")+"'!")
+		return
+	}
+	writeMockJSON(w, http.StatusOK, p.withManagedObjectSelf(r, mo))
+}
+
+// handleUpdateManagedObject merges the top level fragments of the body into the managed object
+func (p *mockPlatform) handleUpdateManagedObject(w http.ResponseWriter, r *http.Request) {
+	update := map[string]any{}
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		writeMockError(w, http.StatusUnprocessableEntity, "inventory/Invalid", err.Error())
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	mo, ok := p.managedObjects[r.PathValue("id")]
+	if !ok {
+		writeMockError(w, http.StatusNotFound, "inventory/Not Found", "No managedObject for id '"+r.PathValue("id")+"'!")
+		return
+	}
+	delete(update, "id")
+	maps.Copy(mo, update)
+	mo["lastUpdated"] = time.Now().Format(time.RFC3339)
+	writeMockJSON(w, http.StatusOK, p.withManagedObjectSelf(r, mo))
+}
+
+func (p *mockPlatform) handleDeleteManagedObject(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	mo, ok := p.managedObjects[id]
+	if !ok {
+		writeMockError(w, http.StatusNotFound, "inventory/Not Found", "No managedObject for id '"+id+"'!")
+		return
+	}
+	if owner, _ := mo["owner"].(string); r.URL.Query().Get("withDeviceUser") == "true" && strings.HasPrefix(owner, deviceUserPrefix) {
+		delete(p.deviceUsers, owner)
+	}
+	delete(p.managedObjects, id)
+	for key, moID := range p.identities {
+		if moID == id {
+			delete(p.identities, key)
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (p *mockPlatform) withManagedObjectSelf(r *http.Request, mo map[string]any) map[string]any {
+	copied := maps.Clone(mo)
+	copied["self"] = fmt.Sprintf("https://%s/inventory/managedObjects/%s", r.Host, mo["id"])
+	return copied
+}
+
+func (p *mockPlatform) handleGetDeviceUser(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	user, ok := p.deviceUsers[r.PathValue("userName")]
+	if !ok {
+		writeMockError(w, http.StatusNotFound, "user/Not Found", "User with username "+r.PathValue("userName")+" not found")
+		return
+	}
+	copied := *user
+	copied.Self = fmt.Sprintf("https://%s/user/%s/users/%s", r.Host, p.tenantID, user.UserName)
+	writeMockJSON(w, http.StatusOK, copied)
+}
+
+func (p *mockPlatform) handleDeleteDeviceUser(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.deviceUsers[r.PathValue("userName")]; !ok {
+		writeMockError(w, http.StatusNotFound, "user/Not Found", "User with username "+r.PathValue("userName")+" not found")
+		return
+	}
+	delete(p.deviceUsers, r.PathValue("userName"))
+	w.WriteHeader(http.StatusNoContent)
+}
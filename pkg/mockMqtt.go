@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"time"
+)
+
+// MQTT stand-in of the mock platform. Devices connect via TLS with their certificate (like on port 8883 of the
+// platform); the certificate must be trusted and the client id must match its common name. Published messages are
+// acknowledged and logged, they are not processed.
+
+// serveMQTT accepts MQTT connections until the listener is closed
+func (p *mockPlatform) serveMQTT(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go p.handleMQTTConnection(conn.(*tls.Conn))
+	}
+}
+
+func (p *mockPlatform) handleMQTTConnection(conn *tls.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Minute))
+	if err := conn.Handshake(); err != nil {
+		slog.Warn("Mock platform MQTT handshake failed", "error", err, "remoteAddress", conn.RemoteAddr())
+		return
+	}
+	reader := bufio.NewReader(conn)
+	packet, err := readMQTTPacket(reader)
+	if err != nil || packet.packetType() != mqttPacketConnect {
+		slog.Warn("Mock platform MQTT expected CONNECT", "error", err, "remoteAddress", conn.RemoteAddr())
+		return
+	}
+	clientID, returnCode := p.checkMQTTConnect(packet.body, conn.ConnectionState().PeerCertificates)
+	slog.Info("Mock platform MQTT connect", "clientId", clientID, "returnCode", returnCode, "reason", mqttConnackReasons[returnCode])
+	if err := writeMQTTPacket(conn, mqttPacketConnack, []byte{0, returnCode}); err != nil || returnCode != 0 {
+		return
+	}
+
+	for {
+		packet, err := readMQTTPacket(reader)
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				slog.Warn("Mock platform MQTT connection closed", "clientId", clientID, "error", err)
+			}
+			return
+		}
+		switch packet.packetType() {
+		case mqttPacketPublish:
+			if err := handleMQTTPublish(conn, clientID, packet); err != nil {
+				slog.Warn("Mock platform MQTT received invalid PUBLISH", "clientId", clientID, "error", err)
+				return
+			}
+		case mqttPacketPingreq:
+			writeMQTTPacket(conn, mqttPacketPingresp, nil)
+		case mqttPacketDisconnect:
+			slog.Info("Mock platform MQTT disconnect", "clientId", clientID)
+			return
+		default:
+			slog.Warn("Mock platform MQTT received unsupported packet", "clientId", clientID, "packetType", packet.packetType())
+			return
+		}
+	}
+}
+
+// checkMQTTConnect returns the client id of the CONNECT packet and the CONNACK return code
+func (p *mockPlatform) checkMQTTConnect(body []byte, peerCertificates []*x509.Certificate) (string, byte) {
+	protocol, rest, err := readMQTTString(body)
+	if err != nil || protocol != "MQTT" || len(rest) < 4 || rest[0] != mqttProtocolLevel {
+		return "", 1
+	}
+	clientID, _, err := readMQTTString(rest[4:])
+	if err != nil {
+		return "", 2
+	}
+	if len(peerCertificates) == 0 {
+		return clientID, 5
+	}
+	cert := peerCertificates[0]
+	if err := p.verifyDeviceCertificate(cert, peerCertificates[1:]); err != nil {
+		slog.Warn("Mock platform MQTT client certificate not trusted", "clientId", clientID, "error", err)
+		return clientID, 5
+	}
+	if clientID != cert.Subject.CommonName {
+		slog.Warn("Mock platform MQTT client id does not match certificate", "clientId", clientID, "commonName", cert.Subject.CommonName)
+		return clientID, 2
+	}
+	p.mu.Lock()
+	p.connectDevice(clientID)
+	p.mu.Unlock()
+	return clientID, 0
+}
+
+func handleMQTTPublish(conn net.Conn, clientID string, packet mqttPacket) error {
+	topic, rest, err := readMQTTString(packet.body)
+	if err != nil {
+		return err
+	}
+	qos := (packet.header >> 1) & 0x03
+	var packetID uint16
+	if qos > 0 {
+		if len(rest) < 2 {
+			return errors.New("missing packet identifier")
+		}
+		packetID = binary.BigEndian.Uint16(rest)
+		rest = rest[2:]
+	}
+	slog.Info("Mock platform MQTT message", "clientId", clientID, "topic", topic, "qos", qos, "message", string(rest))
+	if qos == 1 {
+		return writeMQTTPacket(conn, mqttPacketPuback, binary.BigEndian.AppendUint16(nil, packetID))
+	}
+	return nil
+}
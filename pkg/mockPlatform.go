@@ -0,0 +1,755 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/reubenmiller/go-c8y/pkg/c8y"
+	"github.com/reubenmiller/go-c8y/pkg/certutil"
+	"go.mozilla.org/pkcs7"
+)
+
+// mockPlatform is a minimal in-memory stand-in for the Cumulocity endpoints used during certificate
+// enrollment. It issues real certificates from a CA that is generated on startup.
+type mockPlatform struct {
+	mu sync.Mutex
+
+	domainName string
+	tenantID   string
+	user       string
+	password   string
+	validity   time.Duration
+
+	caKey       *ecdsa.PrivateKey
+	caCert      *x509.Certificate
+	caValidity  time.Duration
+	serverCert  tls.Certificate
+	tokenSecret []byte
+	nextSerial  int64
+
+	registrations  map[string]*mockRegistration
+	managedObjects map[string]map[string]any
+	identities     map[string]string // "<type>/<externalId>" to managed object id
+	deviceUsers    map[string]*mockDeviceUser
+	events         map[string]map[string]any
+	alarms         map[string]map[string]any
+	operations     map[string]map[string]any
+	nextID         int64
+	revoked        map[string]string // serial number (hex) to revocation date
+
+	// the CA always signs server and device certificates, but is only visible as tenant CA once published
+	caPublished        bool
+	caAutoRegistration bool
+
+	trustedCertificates map[string]*mockTrustedCertificate // fingerprint to uploaded trusted certificate
+}
+
+// mockRegistration represents a device registration request (newDeviceRequest) held by the mock platform
+type mockRegistration struct {
+	ID           string `json:"id"`
+	Status       string `json:"status"`
+	Owner        string `json:"owner,omitempty"`
+	CreationTime string `json:"creationTime,omitempty"`
+	TenantID     string `json:"tenantId,omitempty"`
+	Self         string `json:"self,omitempty"`
+	OTP          string `json:"-"`
+
+	// device details applied when the device connects (bulk registration columns NAME, TYPE, IDTYPE)
+	Name         string `json:"-"`
+	Type         string `json:"-"`
+	IdentityType string `json:"-"`
+	Agent        bool   `json:"-"`
+}
+
+func newMockPlatform(domainName string, tenantID string, user string, password string, validity time.Duration, caValidity time.Duration) (*mockPlatform, error) {
+	p := &mockPlatform{
+		domainName:     domainName,
+		tenantID:       tenantID,
+		user:           user,
+		password:       password,
+		validity:       validity,
+		caValidity:     caValidity,
+		nextSerial:     1,
+		registrations:  map[string]*mockRegistration{},
+		managedObjects: map[string]map[string]any{},
+		identities:     map[string]string{},
+		deviceUsers:    map[string]*mockDeviceUser{},
+		events:         map[string]map[string]any{},
+		alarms:         map[string]map[string]any{},
+		operations:     map[string]map[string]any{},
+		revoked:        map[string]string{},
+
+		caPublished:        true,
+		caAutoRegistration: true,
+
+		trustedCertificates: map[string]*mockTrustedCertificate{},
+	}
+
+	if err := p.regenerateCA(); err != nil {
+		return nil, err
+	}
+
+	serverKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serverTemplate := &x509.Certificate{
+		SerialNumber: big.NewInt(p.serial()),
+		Subject:      pkix.Name{CommonName: domainName},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().AddDate(1, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("::1")},
+	}
+	if ip := net.ParseIP(domainName); ip != nil {
+		serverTemplate.IPAddresses = append(serverTemplate.IPAddresses, ip)
+	} else if domainName != "localhost" {
+		serverTemplate.DNSNames = append(serverTemplate.DNSNames, domainName)
+	}
+	serverDER, err := x509.CreateCertificate(rand.Reader, serverTemplate, p.caCert, &serverKey.PublicKey, p.caKey)
+	if err != nil {
+		return nil, err
+	}
+	p.serverCert = tls.Certificate{Certificate: [][]byte{serverDER, p.caCert.Raw}, PrivateKey: serverKey}
+
+	p.tokenSecret = make([]byte, 32)
+	if _, err = rand.Read(p.tokenSecret); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *mockPlatform) serial() int64 {
+	s := p.nextSerial
+	p.nextSerial++
+	return s
+}
+
+// regenerateCA creates a new CA key and a self signed CA certificate for it
+func (p *mockPlatform) regenerateCA() error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	p.caKey = key
+	p.caCert, err = p.issueCACertificate()
+	return err
+}
+
+// issueCACertificate creates a self signed CA certificate for the CA key
+func (p *mockPlatform) issueCACertificate() (*x509.Certificate, error) {
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(p.serial()),
+		Subject:               pkix.Name{CommonName: p.tenantID, Organization: []string{"Cumulocity Mock"}, OrganizationalUnit: []string{"Certificate Authority"}},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(p.caValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &p.caKey.PublicKey, p.caKey)
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(der)
+}
+
+// caCertificatePEM returns the generated CA certificate in PEM format
+func (p *mockPlatform) caCertificatePEM() []byte {
+	return certutil.MarshalCertificateToPEM(p.caCert.Raw)
+}
+
+// apiTLSConfig returns the TLS config for the regular REST API listener
+func (p *mockPlatform) apiTLSConfig() *tls.Config {
+	return &tls.Config{Certificates: []tls.Certificate{p.serverCert}}
+}
+
+// mtlsTLSConfig returns the TLS config for the device access token listener, which requires a client certificate
+func (p *mockPlatform) mtlsTLSConfig() *tls.Config {
+	return &tls.Config{
+		Certificates: []tls.Certificate{p.serverCert},
+		ClientAuth:   tls.RequireAnyClientCert,
+	}
+}
+
+// apiHandler returns the handler serving the REST API endpoints (tenant, user, registrations, EST)
+func (p *mockPlatform) apiHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /tenant/loginOptions", p.handleLoginOptions)
+	mux.HandleFunc("GET /tenant/currentTenant", p.requireUserOrDevice(p.handleCurrentTenant))
+	mux.HandleFunc("GET /user/currentUser", p.requireUserOrDevice(p.handleCurrentUser))
+	mux.HandleFunc("GET /features/{key}", p.requireUser(p.handleFeature))
+	mux.HandleFunc("GET /tenant/tenants/{tenant}/trusted-certificates", p.requireUser(p.handleTrustedCertificates))
+	mux.HandleFunc("POST /devicecontrol/bulkNewDeviceRequests", p.requireUser(p.handleBulkNewDeviceRequests))
+	mux.HandleFunc("GET /devicecontrol/newDeviceRequests", p.requireUser(p.handleListNewDeviceRequests))
+	mux.HandleFunc("POST /devicecontrol/newDeviceRequests", p.requireUser(p.handleCreateNewDeviceRequest))
+	mux.HandleFunc("GET /devicecontrol/newDeviceRequests/{id}", p.requireUser(p.handleGetNewDeviceRequest))
+	mux.HandleFunc("PUT /devicecontrol/newDeviceRequests/{id}", p.requireUser(p.handleUpdateNewDeviceRequest))
+	mux.HandleFunc("DELETE /devicecontrol/newDeviceRequests/{id}", p.requireUser(p.handleDeleteNewDeviceRequest))
+	mux.HandleFunc("POST /.well-known/est/simpleenroll", p.handleSimpleEnroll)
+	mux.HandleFunc("POST /.well-known/est/simplereenroll", p.handleSimpleReEnroll)
+	mux.HandleFunc("PUT /tenant/trusted-certificates/settings/crl", p.requireUser(p.handleRevokeCertificates))
+	p.registerInventoryHandlers(mux)
+	p.registerDeviceDataHandlers(mux)
+	p.registerTenantCAHandlers(mux)
+	p.registerTrustedCertificateHandlers(mux)
+	return logRequests(mux)
+}
+
+// mtlsHandler returns the handler serving the certificate based device access token endpoint
+func (p *mockPlatform) mtlsHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /devicecontrol/deviceAccessToken", p.handleDeviceAccessToken)
+	return logRequests(mux)
+}
+
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		slog.Info("Mock platform request", "method", r.Method, "path", r.URL.Path)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requireUser only passes requests which authenticate with the configured platform user.
+// The username is accepted with or without tenant prefix.
+func (p *mockPlatform) requireUser(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username, password, ok := r.BasicAuth()
+		if ok {
+			username = strings.TrimPrefix(username, p.tenantID+"/")
+		}
+		if !ok || username != p.user || password != p.password {
+			writeMockError(w, http.StatusUnauthorized, "security/Unauthorized", "Invalid credentials!")
+			return
+		}
+		next(w, r)
+	}
+}
+
+func (p *mockPlatform) handleLoginOptions(w http.ResponseWriter, r *http.Request) {
+	writeMockJSON(w, http.StatusOK, c8y.TenantLoginOptions{
+		Self: fmt.Sprintf("https://%s/tenant/loginOptions", r.Host),
+		LoginOptions: []c8y.TenantLoginOption{
+			{ID: "basic", Type: "BASIC", UserManagementSource: "INTERNAL", VisibleOnLoginPage: true},
+			{
+				ID:                   "oauth2_internal",
+				Type:                 "OAUTH2_INTERNAL",
+				UserManagementSource: "INTERNAL",
+				GrantType:            "PASSWORD",
+				InitRequest:          fmt.Sprintf("https://%s/tenant/oauth?tenant_id=%s", r.Host, p.tenantID),
+				VisibleOnLoginPage:   true,
+			},
+		},
+	})
+}
+
+func (p *mockPlatform) handleCurrentTenant(w http.ResponseWriter, r *http.Request) {
+	writeMockJSON(w, http.StatusOK, c8y.CurrentTenant{Name: p.tenantID, DomainName: p.domainName})
+}
+
+// handleCurrentUser returns the platform user or, for device access tokens, the device user
+func (p *mockPlatform) handleCurrentUser(w http.ResponseWriter, r *http.Request) {
+	if claims, err := p.parseDeviceToken(r); err == nil {
+		p.mu.Lock()
+		user, ok := p.deviceUsers[claims.User]
+		p.mu.Unlock()
+		if !ok {
+			writeMockError(w, http.StatusNotFound, "user/Not Found", "User with username "+claims.User+" not found")
+			return
+		}
+		writeMockJSON(w, http.StatusOK, c8y.User{
+			ID:             user.ID,
+			Username:       user.UserName,
+			Enabled:        user.Enabled,
+			EffectiveRoles: []c8y.Role{{ID: "ROLE_DEVICE", Name: "ROLE_DEVICE"}},
+		})
+		return
+	}
+	writeMockJSON(w, http.StatusOK, c8y.User{
+		ID:       p.user,
+		Username: p.user,
+		Enabled:  true,
+		EffectiveRoles: []c8y.Role{
+			{ID: "ROLE_DEVICE_CONTROL_ADMIN", Name: "ROLE_DEVICE_CONTROL_ADMIN"},
+			{ID: "ROLE_DEVICE_CONTROL_READ", Name: "ROLE_DEVICE_CONTROL_READ"},
+			{ID: "ROLE_TENANT_MANAGEMENT_ADMIN", Name: "ROLE_TENANT_MANAGEMENT_ADMIN"},
+		},
+	})
+}
+
+func (p *mockPlatform) handleFeature(w http.ResponseWriter, r *http.Request) {
+	if r.PathValue("key") != certificateAuthorityFeature {
+		writeMockError(w, http.StatusNotFound, "feature/Not Found", "Unknown feature "+r.PathValue("key"))
+		return
+	}
+	writeMockJSON(w, http.StatusOK, c8y.FeatureToggle{
+		Key:      certificateAuthorityFeature,
+		Phase:    c8y.FeaturePhaseGenerallyAvailable,
+		Active:   true,
+		Strategy: c8y.FeatureStrategyDefault,
+	})
+}
+
+func (p *mockPlatform) handleTrustedCertificates(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	certificates := []trustedCertificate{}
+	if p.caPublished {
+		certificates = append(certificates, trustedCertificate{Certificate: p.certificateRepresentation(p.caCert, p.caAutoRegistration)})
+	}
+	for _, t := range p.trustedCertificates {
+		certificates = append(certificates, t.representation())
+	}
+	sort.Slice(certificates, func(i, j int) bool { return certificates[i].Name < certificates[j].Name })
+	writeMockJSON(w, http.StatusOK, map[string]any{"certificates": certificates})
+}
+
+func (p *mockPlatform) certificateRepresentation(cert *x509.Certificate, autoRegistration bool) c8y.Certificate {
+	return c8y.Certificate{
+		AlgorithmName:              cert.SignatureAlgorithm.String(),
+		CertInPemFormat:            base64.StdEncoding.EncodeToString(cert.Raw),
+		Fingerprint:                certificateFingerprint(cert),
+		Issuer:                     cert.Issuer.String(),
+		Name:                       cert.Subject.CommonName,
+		NotAfter:                   cert.NotAfter.Format(time.RFC3339),
+		NotBefore:                  cert.NotBefore.Format(time.RFC3339),
+		SerialNumber:               cert.SerialNumber.String(),
+		Status:                     c8y.CertificateStatusEnabled,
+		Subject:                    cert.Subject.String(),
+		AutoRegistrationEnabled:    &autoRegistration,
+		TenantCertificateAuthority: true,
+		Version:                    cert.Version,
+	}
+}
+
+func (p *mockPlatform) handleBulkNewDeviceRequests(w http.ResponseWriter, r *http.Request) {
+	// the csv contents are either uploaded as file or as plain form field
+	var contents io.Reader
+	file, _, err := r.FormFile("file")
+	if err == nil {
+		defer file.Close()
+		contents = file
+	} else if value := r.FormValue("file"); len(value) > 0 {
+		contents = strings.NewReader(value)
+	} else {
+		writeMockError(w, http.StatusBadRequest, "devicecontrol/BadRequest", "Missing bulk registration file")
+		return
+	}
+
+	result := c8y.BulkNewDeviceRequest{}
+	lines := bufio.NewScanner(contents)
+	var header []string
+	for lines.Scan() {
+		line := strings.TrimSpace(lines.Text())
+		if len(line) == 0 {
+			continue
+		}
+		separator := "\t"
+		if !strings.Contains(line, "\t") {
+			separator = ";"
+		}
+		fields := strings.Split(line, separator)
+		if header == nil {
+			header = fields
+			continue
+		}
+		row := map[string]string{}
+		for i, name := range header {
+			if i < len(fields) {
+				row[strings.TrimSpace(name)] = strings.TrimSpace(fields[i])
+			}
+		}
+		result.NumberOfAll++
+		id := row["ID"]
+		p.mu.Lock()
+		_, exists := p.registrations[id]
+		if !exists && len(id) > 0 {
+			p.registrations[id] = &mockRegistration{
+				ID:           id,
+				Status:       c8y.NewDeviceRequestPendingAcceptance,
+				Owner:        p.user,
+				CreationTime: time.Now().Format(time.RFC3339),
+				TenantID:     p.tenantID,
+				OTP:          row["ENROLLMENT_OTP"],
+				Name:         valueOrDefault(row["NAME"], id),
+				Type:         valueOrDefault(row["TYPE"], "c8y_Device"),
+				IdentityType: valueOrDefault(row["IDTYPE"], deviceIdentityType),
+				Agent:        strings.EqualFold(row["com_cumulocity_model_Agent.active"], "true"),
+			}
+		}
+		p.mu.Unlock()
+		if exists || len(id) == 0 {
+			result.NumberOfFailed++
+			result.FailedCreationList = append(result.FailedCreationList, c8y.BulkNewDeviceRequestDetails{
+				BulkNewDeviceStatus: "FAILED",
+				DeviceID:            id,
+				FailureReason:       "Device registration already exists",
+				Line:                line,
+			})
+			continue
+		}
+		result.NumberOfCreated++
+		result.NumberOfSuccessful++
+	}
+	writeMockJSON(w, http.StatusCreated, result)
+}
+
+func (p *mockPlatform) handleListNewDeviceRequests(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	items := make([]*mockRegistration, 0, len(p.registrations))
+	for _, reg := range p.registrations {
+		items = append(items, p.withSelf(r, reg))
+	}
+	p.mu.Unlock()
+	sort.Slice(items, func(i, j int) bool { return items[i].ID < items[j].ID })
+	writeMockJSON(w, http.StatusOK, map[string]any{"newDeviceRequests": mockPage(r, items)})
+}
+
+func (p *mockPlatform) handleCreateNewDeviceRequest(w http.ResponseWriter, r *http.Request) {
+	body := struct {
+		ID              string `json:"id"`
+		EnrollmentToken string `json:"enrollmentToken"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || len(body.ID) == 0 {
+		writeMockError(w, http.StatusUnprocessableEntity, "devicecontrol/Invalid", "Device registration needs an id")
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, exists := p.registrations[body.ID]; exists {
+		writeMockError(w, http.StatusConflict, "devicecontrol/Conflict", "Device registration already exists: "+body.ID)
+		return
+	}
+	reg := &mockRegistration{
+		ID:           body.ID,
+		Status:       c8y.NewDeviceRequestWaitingForConnection,
+		Owner:        p.user,
+		CreationTime: time.Now().Format(time.RFC3339),
+		TenantID:     p.tenantID,
+		OTP:          body.EnrollmentToken,
+		Name:         body.ID,
+		Type:         "c8y_Device",
+		IdentityType: deviceIdentityType,
+	}
+	p.registrations[body.ID] = reg
+	writeMockJSON(w, http.StatusCreated, p.withSelf(r, reg))
+}
+
+func (p *mockPlatform) handleGetNewDeviceRequest(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	reg, ok := p.registrations[r.PathValue("id")]
+	if !ok {
+		writeMockError(w, http.StatusNotFound, "devicecontrol/Not Found", "Device registration not found: "+r.PathValue("id"))
+		return
+	}
+	writeMockJSON(w, http.StatusOK, p.withSelf(r, reg))
+}
+
+func (p *mockPlatform) handleUpdateNewDeviceRequest(w http.ResponseWriter, r *http.Request) {
+	body := struct {
+		Status string `json:"status"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeMockError(w, http.StatusUnprocessableEntity, "devicecontrol/Invalid", err.Error())
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	reg, ok := p.registrations[r.PathValue("id")]
+	if !ok {
+		writeMockError(w, http.StatusNotFound, "devicecontrol/Not Found", "Device registration not found: "+r.PathValue("id"))
+		return
+	}
+	if body.Status == c8y.NewDeviceRequestAccepted && reg.Status == c8y.NewDeviceRequestWaitingForConnection {
+		writeMockError(w, http.StatusUnprocessableEntity, "devicecontrol/Invalid", "Device did not connect yet: "+reg.ID)
+		return
+	}
+	if len(body.Status) > 0 {
+		reg.Status = body.Status
+	}
+	writeMockJSON(w, http.StatusOK, p.withSelf(r, reg))
+}
+
+func (p *mockPlatform) handleDeleteNewDeviceRequest(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.registrations[r.PathValue("id")]; !ok {
+		writeMockError(w, http.StatusNotFound, "devicecontrol/Not Found", "Device registration not found: "+r.PathValue("id"))
+		return
+	}
+	delete(p.registrations, r.PathValue("id"))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// mockPage returns the page of items selected by the pageSize and currentPage query parameters
+func mockPage[T any](r *http.Request, items []T) []T {
+	pageSize, err := strconv.Atoi(r.URL.Query().Get("pageSize"))
+	if err != nil || pageSize <= 0 {
+		pageSize = 5
+	}
+	currentPage, err := strconv.Atoi(r.URL.Query().Get("currentPage"))
+	if err != nil || currentPage <= 0 {
+		currentPage = 1
+	}
+	start := min((currentPage-1)*pageSize, len(items))
+	return items[start:min(start+pageSize, len(items))]
+}
+
+func (p *mockPlatform) withSelf(r *http.Request, reg *mockRegistration) *mockRegistration {
+	copied := *reg
+	copied.Self = fmt.Sprintf("https://%s/devicecontrol/newDeviceRequests/%s", r.Host, reg.ID)
+	return &copied
+}
+
+// handleSimpleEnroll signs the CSR of a device which authenticates with its external ID and one-time password
+func (p *mockPlatform) handleSimpleEnroll(w http.ResponseWriter, r *http.Request) {
+	externalID, otp, ok := r.BasicAuth()
+	if !ok {
+		writeMockError(w, http.StatusUnauthorized, "security/Unauthorized", "Missing enrollment credentials")
+		return
+	}
+	p.mu.Lock()
+	caPublished := p.caPublished
+	reg, exists := p.registrations[externalID]
+	accepted := exists && (len(reg.OTP) == 0 || reg.OTP == otp) && reg.Status != c8y.NewDeviceRequestAccepted
+	p.mu.Unlock()
+	if !caPublished {
+		writeMockError(w, http.StatusUnprocessableEntity, "est/Unprocessable", "Tenant has no certificate authority")
+		return
+	}
+	if !exists {
+		writeMockError(w, http.StatusNotFound, "devicecontrol/Not Found", "No device registration found for "+externalID)
+		return
+	}
+	if !accepted {
+		writeMockError(w, http.StatusUnauthorized, "security/Unauthorized", "Invalid one-time password or registration already completed")
+		return
+	}
+
+	csr, err := readMockCSR(r)
+	if err != nil {
+		writeMockError(w, http.StatusBadRequest, "est/BadRequest", err.Error())
+		return
+	}
+	if csr.Subject.CommonName != externalID {
+		writeMockError(w, http.StatusBadRequest, "est/BadRequest", "CSR common name does not match external ID")
+		return
+	}
+	if err := p.writeSignedCertificate(w, csr); err != nil {
+		slog.Error("Error while issuing device certificate", "error", err, "deviceID", externalID)
+		return
+	}
+
+	p.mu.Lock()
+	reg.Status = c8y.NewDeviceRequestAccepted
+	p.mu.Unlock()
+}
+
+// handleSimpleReEnroll signs a new CSR of a device which authenticates with a device access token
+func (p *mockPlatform) handleSimpleReEnroll(w http.ResponseWriter, r *http.Request) {
+	claims, err := p.parseDeviceToken(r)
+	if err != nil {
+		writeMockError(w, http.StatusUnauthorized, "security/Unauthorized", err.Error())
+		return
+	}
+	csr, err := readMockCSR(r)
+	if err != nil {
+		writeMockError(w, http.StatusBadRequest, "est/BadRequest", err.Error())
+		return
+	}
+	if deviceUserPrefix+csr.Subject.CommonName != claims.User {
+		writeMockError(w, http.StatusForbidden, "security/Forbidden", "CSR common name does not match the authenticated device")
+		return
+	}
+	if err := p.writeSignedCertificate(w, csr); err != nil {
+		slog.Error("Error while issuing device certificate", "error", err, "user", claims.User)
+	}
+}
+
+// handleDeviceAccessToken issues a device access token for a client certificate issued by the mock CA
+func (p *mockPlatform) handleDeviceAccessToken(w http.ResponseWriter, r *http.Request) {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		writeMockError(w, http.StatusUnauthorized, "security/Unauthorized", "Missing client certificate")
+		return
+	}
+	cert := r.TLS.PeerCertificates[0]
+	if err := p.verifyDeviceCertificate(cert, r.TLS.PeerCertificates[1:]); err != nil {
+		writeMockError(w, http.StatusUnauthorized, "security/Unauthorized", "Client certificate not trusted: "+err.Error())
+		return
+	}
+
+	p.mu.Lock()
+	p.connectDevice(cert.Subject.CommonName)
+	p.mu.Unlock()
+
+	now := time.Now()
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, &c8y.CumulocityTokenClaim{
+		User:   deviceUserPrefix + cert.Subject.CommonName,
+		Tenant: p.tenantID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    p.domainName,
+			Audience:  jwt.ClaimStrings{p.domainName},
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(time.Hour)),
+		},
+	})
+	signed, err := token.SignedString(p.tokenSecret)
+	if err != nil {
+		writeMockError(w, http.StatusInternalServerError, "security/Error", err.Error())
+		return
+	}
+	writeMockJSON(w, http.StatusOK, c8y.AccessToken{AccessToken: signed})
+}
+
+// handleRevokeCertificates adds certificates to the revocation list of the tenant
+func (p *mockPlatform) handleRevokeCertificates(w http.ResponseWriter, r *http.Request) {
+	body := struct {
+		Crls []revokedCertificate `json:"crls"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || len(body.Crls) == 0 {
+		writeMockError(w, http.StatusUnprocessableEntity, "tenant/Invalid", "Revocation list needs at least one entry")
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, crl := range body.Crls {
+		p.revoked[normalizeSerial(crl.SerialNumberInHex)] = crl.RevocationDate
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// verifyDeviceCertificate checks that the certificate chains (via the intermediates sent by the client) to the CA or
+// an enabled trusted certificate and is not revoked
+func (p *mockPlatform) verifyDeviceCertificate(cert *x509.Certificate, intermediates []*x509.Certificate) error {
+	p.mu.Lock()
+	revocationDate, revoked := p.revoked[serialToHex(cert.SerialNumber)]
+	roots := x509.NewCertPool()
+	roots.AddCert(p.caCert)
+	for _, t := range p.trustedCertificates {
+		if t.status == c8y.CertificateStatusEnabled {
+			roots.AddCert(t.cert)
+		}
+	}
+	p.mu.Unlock()
+	if revoked {
+		return fmt.Errorf("certificate %s revoked at %s", serialToHex(cert.SerialNumber), revocationDate)
+	}
+	intermediatePool := x509.NewCertPool()
+	for _, intermediate := range intermediates {
+		intermediatePool.AddCert(intermediate)
+	}
+	_, err := cert.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediatePool,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	return err
+}
+
+func (p *mockPlatform) parseDeviceToken(r *http.Request) (*c8y.CumulocityTokenClaim, error) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return nil, errors.New("Missing bearer token")
+	}
+	claims := &c8y.CumulocityTokenClaim{}
+	_, err := jwt.ParseWithClaims(strings.TrimPrefix(auth, "Bearer "), claims, func(t *jwt.Token) (interface{}, error) {
+		return p.tokenSecret, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
+	if err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func (p *mockPlatform) writeSignedCertificate(w http.ResponseWriter, csr *x509.CertificateRequest) error {
+	cert, err := p.signCSR(csr)
+	if err != nil {
+		writeMockError(w, http.StatusInternalServerError, "est/Error", err.Error())
+		return err
+	}
+	degenerate, err := pkcs7.DegenerateCertificate(cert.Raw)
+	if err != nil {
+		writeMockError(w, http.StatusInternalServerError, "est/Error", err.Error())
+		return err
+	}
+	w.Header().Set("Content-Type", "application/pkcs7-mime; smime-type=certs-only")
+	w.Header().Set("Content-Transfer-Encoding", "base64")
+	w.WriteHeader(http.StatusOK)
+	_, err = w.Write([]byte(base64.StdEncoding.EncodeToString(degenerate)))
+	return err
+}
+
+func (p *mockPlatform) signCSR(csr *x509.CertificateRequest) (*x509.Certificate, error) {
+	p.mu.Lock()
+	serial := p.serial()
+	caCert := p.caCert
+	p.mu.Unlock()
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      csr.Subject,
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(p.validity),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, csr.PublicKey, p.caKey)
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("Mock platform issued certificate", "commonName", csr.Subject.CommonName, "serial", serial)
+	return x509.ParseCertificate(der)
+}
+
+func readMockCSR(r *http.Request) (*x509.CertificateRequest, error) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	der, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(body)))
+	if err != nil {
+		return nil, fmt.Errorf("CSR is not base64 encoded: %w", err)
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		return nil, err
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return nil, err
+	}
+	return csr, nil
+}
+
+func writeMockJSON(w http.ResponseWriter, statusCode int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+func writeMockError(w http.ResponseWriter, statusCode int, errorType string, message string) {
+	writeMockJSON(w, statusCode, map[string]string{"error": errorType, "message": message})
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/reubenmiller/go-c8y/pkg/c8y"
+	"github.com/reubenmiller/go-c8y/pkg/certutil"
+)
+
+// testPlatform is the mock platform of serveMock, served on random local ports
+type testPlatform struct {
+	*mockPlatform
+	host string
+}
+
+// startTestPlatform serves a mock platform until the end of the test. The device access token endpoint is
+// reachable on port 8443 of the host, like go-c8y expects it.
+func startTestPlatform(t *testing.T) *testPlatform {
+	t.Helper()
+	platform, err := newMockPlatform("127.0.0.1", "t12345", "admin", "admin", 24*time.Hour, 240*time.Hour)
+	if err != nil {
+		t.Fatalf("creating mock platform: %v", err)
+	}
+	api := httptest.NewUnstartedServer(platform.apiHandler())
+	api.TLS = platform.apiTLSConfig()
+	api.StartTLS()
+	t.Cleanup(api.Close)
+	mtls := httptest.NewUnstartedServer(platform.mtlsHandler())
+	mtls.TLS = platform.mtlsTLSConfig()
+	mtls.StartTLS()
+	t.Cleanup(mtls.Close)
+	routeAccessTokenEndpoint(t, mtls.Listener.Addr().String())
+	return &testPlatform{mockPlatform: platform, host: api.URL}
+}
+
+// routeAccessTokenEndpoint connects requests to port 8443 to the given address instead. All clients of the
+// commands derive their transport from the default transport, which is replaced until the end of the test.
+func routeAccessTokenEndpoint(t *testing.T, address string) {
+	t.Helper()
+	defaultTransport := http.DefaultTransport
+	tr := defaultTransport.(*http.Transport).Clone()
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	tr.DialContext = func(ctx context.Context, network string, addr string) (net.Conn, error) {
+		if _, port, _ := net.SplitHostPort(addr); port == "8443" {
+			addr = address
+		}
+		return dialer.DialContext(ctx, network, addr)
+	}
+	http.DefaultTransport = tr
+	t.Cleanup(func() { http.DefaultTransport = defaultTransport })
+}
+
+func (p *testPlatform) adminClient() *c8y.Client {
+	return newC8yClient(p.host, p.tenantID, p.user, p.password)
+}
+
+// issueDeviceCertificate returns a certificate of the tenant CA for the device, as PEM of certificate and key
+func (p *testPlatform) issueDeviceCertificate(t *testing.T, deviceID string) ([]byte, []byte) {
+	t.Helper()
+	keyPEM, err := certutil.MakeEllipticPrivateKeyPEM()
+	if err != nil {
+		t.Fatalf("creating private key: %v", err)
+	}
+	key, err := certutil.ParsePrivateKeyPEM(keyPEM)
+	if err != nil {
+		t.Fatalf("parsing private key: %v", err)
+	}
+	csr, err := createDeviceCSR(deviceID, key)
+	if err != nil {
+		t.Fatalf("creating certificate signing request: %v", err)
+	}
+	cert, err := p.signCSR(csr)
+	if err != nil {
+		t.Fatalf("signing certificate: %v", err)
+	}
+	return certutil.MarshalCertificateToPEM(cert.Raw), keyPEM
+}
+
+// writeDeviceCertificate issues a certificate for the device and writes certificate and key to the directory
+func (p *testPlatform) writeDeviceCertificate(t *testing.T, dir string, deviceID string) (string, string, tls.Certificate) {
+	t.Helper()
+	certPEM, keyPEM := p.issueDeviceCertificate(t, deviceID)
+	certFile := filepath.Join(dir, "certificate.pem")
+	keyFile := filepath.Join(dir, "private-key.pem")
+	if err := os.WriteFile(certFile, certPEM, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	clientCert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatalf("loading client certificate: %v", err)
+	}
+	return certFile, keyFile, clientCert
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+)
+
+// Tenant CA endpoints of the mock platform. The mock starts with a published CA unless started with
+// --without-tenant-ca, so that creating the tenant CA can be tried as well. Listing, updating and deleting the tenant CA
+// is served by the trusted certificate endpoints.
+
+func (p *mockPlatform) registerTenantCAHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("POST /certificate-authority", p.requireUser(p.handleCreateTenantCA))
+}
+
+func (p *mockPlatform) handleCreateTenantCA(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.caPublished {
+		writeMockError(w, http.StatusConflict, "certificate-authority/Conflict", "Tenant certificate authority exists already")
+		return
+	}
+	p.caPublished = true
+	slog.Info("Mock platform created tenant CA", "fingerprint", certificateFingerprint(p.caCert))
+	writeMockJSON(w, http.StatusCreated, p.certificateRepresentation(p.caCert, p.caAutoRegistration))
+}
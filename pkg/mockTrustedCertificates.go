@@ -0,0 +1,217 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/reubenmiller/go-c8y/pkg/c8y"
+)
+
+// Trusted certificate endpoints of the mock platform. Uploaded (enabled) certificates are trusted for device
+// access tokens next to the tenant CA. The tenant CA is listed and can be updated or deleted like the uploaded ones.
+
+// mockTrustedCertificate represents a certificate uploaded to the trusted certificates of the tenant
+type mockTrustedCertificate struct {
+	cert              *x509.Certificate
+	name              string
+	status            string
+	autoRegistration  bool
+	verificationCode  string // unsigned proof of possession code, empty until requested
+	codeUsableUntil   time.Time
+	proofOfPossession bool
+}
+
+func (p *mockPlatform) registerTrustedCertificateHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("POST /tenant/tenants/{tenant}/trusted-certificates", p.requireUser(p.handleUploadTrustedCertificate))
+	mux.HandleFunc("GET /tenant/tenants/{tenant}/trusted-certificates/{fingerprint}", p.requireUser(p.handleGetTrustedCertificate))
+	mux.HandleFunc("PUT /tenant/tenants/{tenant}/trusted-certificates/{fingerprint}", p.requireUser(p.handleUpdateTrustedCertificate))
+	mux.HandleFunc("DELETE /tenant/tenants/{tenant}/trusted-certificates/{fingerprint}", p.requireUser(p.handleDeleteTrustedCertificate))
+	mux.HandleFunc("POST /tenant/tenants/{tenant}/trusted-certificates-pop/{fingerprint}/verification-code", p.requireUser(p.handleVerificationCode))
+	mux.HandleFunc("POST /tenant/tenants/{tenant}/trusted-certificates-pop/{fingerprint}/pop", p.requireUser(p.handleProofOfPossession))
+}
+
+func (t *mockTrustedCertificate) representation() trustedCertificate {
+	autoRegistration := t.autoRegistration
+	proofOfPossession := t.proofOfPossession
+	return trustedCertificate{
+		Certificate: c8y.Certificate{
+			AlgorithmName:           t.cert.SignatureAlgorithm.String(),
+			CertInPemFormat:         base64.StdEncoding.EncodeToString(t.cert.Raw),
+			Fingerprint:             certificateFingerprint(t.cert),
+			Issuer:                  t.cert.Issuer.String(),
+			Name:                    t.name,
+			NotAfter:                t.cert.NotAfter.Format(time.RFC3339),
+			NotBefore:               t.cert.NotBefore.Format(time.RFC3339),
+			SerialNumber:            t.cert.SerialNumber.String(),
+			Status:                  t.status,
+			Subject:                 t.cert.Subject.String(),
+			AutoRegistrationEnabled: &autoRegistration,
+			Version:                 t.cert.Version,
+		},
+		ProofOfPossessionValid: &proofOfPossession,
+	}
+}
+
+// isTenantCA tells if the fingerprint belongs to the (published) tenant CA. The caller must hold the lock.
+func (p *mockPlatform) isTenantCA(fingerprint string) bool {
+	return p.caPublished && fingerprint == certificateFingerprint(p.caCert)
+}
+
+func (p *mockPlatform) handleUploadTrustedCertificate(w http.ResponseWriter, r *http.Request) {
+	body := c8y.Certificate{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeMockError(w, http.StatusUnprocessableEntity, "tenant/Invalid", err.Error())
+		return
+	}
+	cert, err := parseTrustedCertificate(&body)
+	if err != nil {
+		writeMockError(w, http.StatusUnprocessableEntity, "tenant/Invalid", "Invalid certificate: "+err.Error())
+		return
+	}
+	fingerprint := certificateFingerprint(cert)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, exists := p.trustedCertificates[fingerprint]; exists || p.isTenantCA(fingerprint) {
+		writeMockError(w, http.StatusConflict, "tenant/Conflict", "Trusted certificate exists already: "+fingerprint)
+		return
+	}
+	t := &mockTrustedCertificate{
+		cert:             cert,
+		name:             valueOrDefault(body.Name, cert.Subject.CommonName),
+		status:           valueOrDefault(body.Status, c8y.CertificateStatusEnabled),
+		autoRegistration: body.IsAutoRegistrationEnabled(),
+	}
+	p.trustedCertificates[fingerprint] = t
+	slog.Info("Mock platform added trusted certificate", "name", t.name, "fingerprint", fingerprint)
+	writeMockJSON(w, http.StatusCreated, t.representation())
+}
+
+func (p *mockPlatform) handleGetTrustedCertificate(w http.ResponseWriter, r *http.Request) {
+	fingerprint := r.PathValue("fingerprint")
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.isTenantCA(fingerprint) {
+		writeMockJSON(w, http.StatusOK, p.certificateRepresentation(p.caCert, p.caAutoRegistration))
+		return
+	}
+	t, ok := p.trustedCertificates[fingerprint]
+	if !ok {
+		writeMockError(w, http.StatusNotFound, "tenant/Not Found", "Trusted certificate not found: "+fingerprint)
+		return
+	}
+	writeMockJSON(w, http.StatusOK, t.representation())
+}
+
+// handleUpdateTrustedCertificate changes status and auto registration of a trusted certificate (only auto registration for the tenant CA)
+func (p *mockPlatform) handleUpdateTrustedCertificate(w http.ResponseWriter, r *http.Request) {
+	body := c8y.Certificate{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeMockError(w, http.StatusUnprocessableEntity, "tenant/Invalid", err.Error())
+		return
+	}
+	fingerprint := r.PathValue("fingerprint")
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.isTenantCA(fingerprint) {
+		if body.AutoRegistrationEnabled != nil {
+			p.caAutoRegistration = *body.AutoRegistrationEnabled
+		}
+		writeMockJSON(w, http.StatusOK, p.certificateRepresentation(p.caCert, p.caAutoRegistration))
+		return
+	}
+	t, ok := p.trustedCertificates[fingerprint]
+	if !ok {
+		writeMockError(w, http.StatusNotFound, "tenant/Not Found", "Trusted certificate not found: "+fingerprint)
+		return
+	}
+	if len(body.Status) > 0 {
+		t.status = body.Status
+	}
+	if body.AutoRegistrationEnabled != nil {
+		t.autoRegistration = *body.AutoRegistrationEnabled
+	}
+	writeMockJSON(w, http.StatusOK, t.representation())
+}
+
+func (p *mockPlatform) handleDeleteTrustedCertificate(w http.ResponseWriter, r *http.Request) {
+	fingerprint := r.PathValue("fingerprint")
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.isTenantCA(fingerprint) {
+		// like the platform, the tenant CA is created with a new key pair afterwards
+		if err := p.regenerateCA(); err != nil {
+			writeMockError(w, http.StatusInternalServerError, "tenant/Error", err.Error())
+			return
+		}
+		p.caPublished = false
+		slog.Info("Mock platform deleted tenant CA", "fingerprint", fingerprint)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if _, ok := p.trustedCertificates[fingerprint]; !ok {
+		writeMockError(w, http.StatusNotFound, "tenant/Not Found", "Trusted certificate not found: "+fingerprint)
+		return
+	}
+	delete(p.trustedCertificates, fingerprint)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleVerificationCode issues the code the owner of the certificate has to sign with its private key
+func (p *mockPlatform) handleVerificationCode(w http.ResponseWriter, r *http.Request) {
+	fingerprint := r.PathValue("fingerprint")
+	code := make([]byte, 32)
+	if _, err := rand.Read(code); err != nil {
+		writeMockError(w, http.StatusInternalServerError, "tenant/Error", err.Error())
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	t, ok := p.trustedCertificates[fingerprint]
+	if !ok {
+		writeMockError(w, http.StatusNotFound, "tenant/Not Found", "Trusted certificate not found: "+fingerprint)
+		return
+	}
+	t.verificationCode = hex.EncodeToString(code)
+	t.codeUsableUntil = time.Now().Add(10 * time.Minute)
+	representation := t.representation()
+	representation.ProofOfPossessionUnsignedVerificationCode = t.verificationCode
+	representation.ProofOfPossessionVerificationCodeUsableUntil = t.codeUsableUntil.Format(time.RFC3339)
+	writeMockJSON(w, http.StatusOK, representation)
+}
+
+// handleProofOfPossession checks the signed verification code against the public key of the certificate
+func (p *mockPlatform) handleProofOfPossession(w http.ResponseWriter, r *http.Request) {
+	body := struct {
+		SignedCode string `json:"proofOfPossessionSignedVerificationCode"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeMockError(w, http.StatusUnprocessableEntity, "tenant/Invalid", err.Error())
+		return
+	}
+	fingerprint := r.PathValue("fingerprint")
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	t, ok := p.trustedCertificates[fingerprint]
+	if !ok {
+		writeMockError(w, http.StatusNotFound, "tenant/Not Found", "Trusted certificate not found: "+fingerprint)
+		return
+	}
+	if len(t.verificationCode) == 0 || time.Now().After(t.codeUsableUntil) {
+		writeMockError(w, http.StatusUnprocessableEntity, "tenant/Invalid", "No valid verification code. Request a new one.")
+		return
+	}
+	if err := verifySHA256Signature(t.cert.PublicKey, []byte(t.verificationCode), body.SignedCode); err != nil {
+		writeMockError(w, http.StatusUnprocessableEntity, "tenant/Invalid", "Verification code signature is invalid: "+err.Error())
+		return
+	}
+	t.proofOfPossession = true
+	t.verificationCode = ""
+	slog.Info("Mock platform verified proof of possession", "fingerprint", fingerprint)
+	writeMockJSON(w, http.StatusOK, t.representation())
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Minimal MQTT 3.1.1 packet handling: enough to connect with a client certificate and publish a SmartREST message
+// (verifyCert), and to serve these packets in the mock platform.
+
+const (
+	mqttPacketConnect    byte = 0x10
+	mqttPacketConnack    byte = 0x20
+	mqttPacketPublish    byte = 0x30
+	mqttPacketPuback     byte = 0x40
+	mqttPacketPingreq    byte = 0xC0
+	mqttPacketPingresp   byte = 0xD0
+	mqttPacketDisconnect byte = 0xE0
+
+	mqttProtocolLevel = 4 // MQTT 3.1.1
+	mqttQoS1          = 0x02
+)
+
+// CONNACK return codes
+var mqttConnackReasons = map[byte]string{
+	0: "connection accepted",
+	1: "unacceptable protocol version",
+	2: "identifier rejected",
+	3: "server unavailable",
+	4: "bad user name or password",
+	5: "not authorized",
+}
+
+type mqttPacket struct {
+	header byte
+	body   []byte
+}
+
+// packetType returns the packet type (upper 4 bits of the fixed header)
+func (p mqttPacket) packetType() byte {
+	return p.header & 0xF0
+}
+
+func writeMQTTPacket(w io.Writer, header byte, body []byte) error {
+	packet := []byte{header}
+	// remaining length: 7 bits per byte, highest bit tells that another byte follows
+	length := len(body)
+	for {
+		b := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			b |= 0x80
+		}
+		packet = append(packet, b)
+		if length == 0 {
+			break
+		}
+	}
+	_, err := w.Write(append(packet, body...))
+	return err
+}
+
+func readMQTTPacket(r *bufio.Reader) (mqttPacket, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return mqttPacket{}, err
+	}
+	length, multiplier := 0, 1
+	for i := 0; ; i++ {
+		if i == 4 {
+			return mqttPacket{}, errors.New("malformed remaining length")
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return mqttPacket{}, err
+		}
+		length += int(b&0x7F) * multiplier
+		multiplier *= 128
+		if b&0x80 == 0 {
+			break
+		}
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return mqttPacket{}, err
+	}
+	return mqttPacket{header: header, body: body}, nil
+}
+
+func mqttString(s string) []byte {
+	return append(binary.BigEndian.AppendUint16(nil, uint16(len(s))), s...)
+}
+
+// readMQTTString returns the string at the start of data and the remaining data
+func readMQTTString(data []byte) (string, []byte, error) {
+	if len(data) < 2 {
+		return "", nil, errors.New("malformed string")
+	}
+	length := int(binary.BigEndian.Uint16(data))
+	if len(data) < 2+length {
+		return "", nil, errors.New("malformed string")
+	}
+	return string(data[2 : 2+length]), data[2+length:], nil
+}
+
+// mqttConnect sends CONNECT (clean session, no user name as the client certificate authenticates) and waits for CONNACK
+func mqttConnect(w io.Writer, r *bufio.Reader, clientID string, keepAliveSeconds uint16) error {
+	body := mqttString("MQTT")
+	body = append(body, mqttProtocolLevel, 0x02)
+	body = binary.BigEndian.AppendUint16(body, keepAliveSeconds)
+	body = append(body, mqttString(clientID)...)
+	if err := writeMQTTPacket(w, mqttPacketConnect, body); err != nil {
+		return fmt.Errorf("error while sending CONNECT: %w", err)
+	}
+	packet, err := readMQTTPacket(r)
+	if err != nil {
+		return fmt.Errorf("error while waiting for CONNACK: %w", err)
+	}
+	if packet.packetType() != mqttPacketConnack || len(packet.body) != 2 {
+		return fmt.Errorf("expected CONNACK, received packet type 0x%02X", packet.packetType())
+	}
+	if returnCode := packet.body[1]; returnCode != 0 {
+		return fmt.Errorf("connection refused with return code %d (%s)", returnCode, mqttConnackReasons[returnCode])
+	}
+	return nil
+}
+
+// mqttPublish publishes a message with QoS 1 and waits for the PUBACK
+func mqttPublish(w io.Writer, r *bufio.Reader, topic string, message string, packetID uint16) error {
+	body := mqttString(topic)
+	body = binary.BigEndian.AppendUint16(body, packetID)
+	body = append(body, message...)
+	if err := writeMQTTPacket(w, mqttPacketPublish|mqttQoS1, body); err != nil {
+		return fmt.Errorf("error while sending PUBLISH: %w", err)
+	}
+	for {
+		packet, err := readMQTTPacket(r)
+		if err != nil {
+			return fmt.Errorf("error while waiting for PUBACK: %w", err)
+		}
+		// messages of subscriptions kept by the server are skipped
+		if packet.packetType() != mqttPacketPuback {
+			continue
+		}
+		if len(packet.body) != 2 || binary.BigEndian.Uint16(packet.body) != packetID {
+			return errors.New("received PUBACK for another packet")
+		}
+		return nil
+	}
+}
+
+func mqttDisconnect(w io.Writer) error {
+	return writeMQTTPacket(w, mqttPacketDisconnect, nil)
+}
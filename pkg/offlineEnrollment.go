@@ -0,0 +1,321 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/reubenmiller/go-c8y/pkg/certutil"
+)
+
+// Command group splitting the enrollment for devices without platform access: the device creates a request bundle
+// offline, a system with platform access processes it and the device imports the resulting response bundle.
+type CmdGroupOfflineEnrollment struct {
+	Request CmdOfflineEnrollmentRequest `command:"request" description:"Create private key, CSR and one-time password and write a signed request bundle (offline, on the device)"`
+	Process CmdOfflineEnrollmentProcess `command:"process" description:"Register the device of a request bundle, enroll its CSR and write the response bundle (online, using provided user credentials)"`
+	Import  CmdOfflineEnrollmentImport  `command:"import" description:"Import the certificate of a response bundle (offline, on the device)"`
+}
+
+type CmdOfflineEnrollmentRequest struct {
+	DeviceId string `long:"device-id" description:"Provide identifier for your Cloud device, e.g. 'kobu-edge-01'. Free text but needs to be unique." required:"true"`
+	Otp      string `long:"one-time-password" description:"One-time password for the enrollment. Generated when missing" required:"false"`
+	Output   string `long:"output" description:"File path of the request bundle. Default: c8y-enrollment-request-<device-id>.json"`
+}
+
+type CmdOfflineEnrollmentProcess struct {
+	C8yHost     string `long:"cumulocity-host" description:"Provide platform endpoint, e.g. 'https://iot.eu-latest.cumulocity.com'" required:"true"`
+	C8yTenantId string `long:"cumulocity-tenant-id" description:"Provide platform tenand id, e.g. 't4009123'. Optional (resolved from host when missing)" required:"false"`
+	C8yUser     string `long:"cumulocity-user" description:"Provide your platform user, e.g. 'john.doe@example.org'" required:"true"`
+	C8yPassword string `long:"cumulocity-password" description:"Provide your platform users password, e.g. 'aVerySecretPass1337'" required:"true"`
+	Request     string `long:"request" description:"File path of the request bundle created on the device" required:"true"`
+	Output      string `long:"output" description:"File path of the response bundle. Default: c8y-enrollment-response-<device-id>.json"`
+}
+
+type CmdOfflineEnrollmentImport struct {
+	Response   string `long:"response" description:"File path of the response bundle" required:"true"`
+	PrivateKey string `long:"private-key" description:"Private key the request bundle was created with. Default: c8y-private-key-<device-id>.pem"`
+}
+
+var offlineEnrollmentCmdName = "offlineEnrollment"
+var offlineEnrollmentCmdGroup CmdGroupOfflineEnrollment
+
+const fileNameTemplateRequestBundle = "c8y-enrollment-request-%s.json"
+const fileNameTemplateResponseBundle = "c8y-enrollment-response-%s.json"
+
+const (
+	bundleTypeEnrollmentRequest  = "c8y-enrollment-request"
+	bundleTypeEnrollmentResponse = "c8y-enrollment-response"
+)
+
+// File exchanged between device and online system. The payload is base64 encoded JSON, so that the signature covers
+// exactly the transferred bytes. Request bundles are signed with the private key of the device.
+type enrollmentBundle struct {
+	Type      string `json:"type"`
+	Payload   string `json:"payload"`
+	Signature string `json:"signature,omitempty"`
+}
+
+type enrollmentRequest struct {
+	DeviceID        string `json:"deviceId"`
+	CSR             string `json:"csr"`
+	OneTimePassword string `json:"oneTimePassword"`
+	CreatedAt       string `json:"createdAt"`
+}
+
+type enrollmentResponse struct {
+	DeviceID      string `json:"deviceId"`
+	Certificate   string `json:"certificate"`
+	CACertificate string `json:"caCertificate,omitempty"`
+	C8yHost       string `json:"c8yHost"`
+	TenantID      string `json:"tenantId"`
+	CreatedAt     string `json:"createdAt"`
+}
+
+func (g *CmdOfflineEnrollmentRequest) Execute(args []string) error {
+	slog.Info(fmt.Sprintf("Started %s request with arguments: DeviceId=%s Output=%s", offlineEnrollmentCmdName, g.DeviceId, g.Output))
+
+	deviceID := g.DeviceId
+	privateKeyFileName := fmt.Sprintf(fileNameTemplatePrivateKey, deviceID)
+	keyPem, e := readFromFile(privateKeyFileName)
+	switch {
+	case e == nil:
+		// a request which is created again (e.g. with a new one-time password) keeps the key
+		slog.Info("Using existing private key", "fileName", privateKeyFileName)
+	case os.IsNotExist(e):
+		slog.Info("Creating private key for device-id", "deviceID", deviceID)
+		if keyPem, e = certutil.MakeEllipticPrivateKeyPEM(); e != nil {
+			slog.Error("Error wile creating private key. Exiting now.", "error", e, "deviceID", deviceID)
+			os.Exit(exitCodeGeneralProcessingError)
+		}
+		if e := writeToFile(string(keyPem), privateKeyFileName); e != nil {
+			slog.Error("Error while writing file. Exiting now.", "error", e, "fileName", privateKeyFileName)
+			os.Exit(exitCodeGeneralProcessingError)
+		}
+	default:
+		slog.Error("Error while reading private key. Exiting now.", "error", e, "fileName", privateKeyFileName)
+		os.Exit(exitCodePrerequisitesNotFulfilled)
+	}
+	key, e := readSigningKey(privateKeyFileName, nil)
+	if e != nil {
+		slog.Error("Error wile parsing private key. Exiting now.", "error", e, "deviceID", deviceID)
+		os.Exit(exitCodeGeneralProcessingError)
+	}
+
+	slog.Info("Creating certificate signing request", "deviceID", deviceID)
+	csr, e := createDeviceCSR(deviceID, key)
+	if e != nil {
+		slog.Error("Error while creating Certificate signing request. Exiting now.", "error", e)
+		os.Exit(exitCodeGeneralProcessingError)
+	}
+	otp := g.Otp
+	if len(otp) == 0 {
+		if otp, e = generateOneTimePassword(); e != nil {
+			slog.Error("Error while creating one time password", "error", e, "deviceID", deviceID)
+			os.Exit(exitCodeGeneralProcessingError)
+		}
+	}
+
+	payload, _ := json.Marshal(enrollmentRequest{
+		DeviceID:        deviceID,
+		CSR:             string(certutil.MarshalCertificateSigningRequestToPEM(csr.Raw)),
+		OneTimePassword: otp,
+		CreatedAt:       time.Now().UTC().Format(time.RFC3339),
+	})
+	signature, e := signSHA256(key, payload)
+	if e != nil {
+		slog.Error("Error while signing request bundle. Exiting now.", "error", e)
+		os.Exit(exitCodeGeneralProcessingError)
+	}
+	bundle := enrollmentBundle{Type: bundleTypeEnrollmentRequest, Payload: base64.StdEncoding.EncodeToString(payload), Signature: signature}
+	fileName := valueOrDefault(g.Output, fmt.Sprintf(fileNameTemplateRequestBundle, deviceID))
+	if e := writeEnrollmentBundle(bundle, fileName); e != nil {
+		slog.Error("Error while writing request bundle. Exiting now.", "error", e, "fileName", fileName)
+		os.Exit(exitCodeGeneralProcessingError)
+	}
+	slog.Info(fmt.Sprintf("Placed request bundle '%s'. Transfer it to a system with platform access and run '%s process'. It contains the one-time password, handle it confidentially.",
+		fileName, offlineEnrollmentCmdName), "deviceID", deviceID)
+	return nil
+}
+
+func (g *CmdOfflineEnrollmentProcess) Execute(args []string) error {
+	slog.Info(fmt.Sprintf("Started %s process with arguments: C8yHost=%s C8yTenantId=%s C8yUser=%s C8yPassword=%s Request=%s Output=%s",
+		offlineEnrollmentCmdName, g.C8yHost, g.C8yTenantId, g.C8yUser, "{obfuscated}", g.Request, g.Output))
+
+	request, csr, e := readEnrollmentRequest(g.Request)
+	if e != nil {
+		slog.Error("Error while reading request bundle. Exiting now.", "error", e, "fileName", g.Request)
+		os.Exit(exitCodePrerequisitesNotFulfilled)
+	}
+	deviceID, otp := request.DeviceID, request.OneTimePassword
+	redactSecret(otp)
+	slog.Info("Verified request bundle", "deviceID", deviceID, "createdAt", request.CreatedAt)
+
+	tenantID := resolveTenantIDOrExit(g.C8yHost, g.C8yTenantId, g.C8yUser, g.C8yPassword)
+	client := newC8yClient(g.C8yHost, tenantID, g.C8yUser, g.C8yPassword)
+
+	slog.Info("Testing user for having the required permissions")
+	if e := checkForRequiredRoles(client, "ROLE_DEVICE_CONTROL_ADMIN"); e != nil {
+		slog.Error("Error while checking User permissions. Exiting now.", "error", e)
+		os.Exit(exitCodePrerequisitesNotFulfilled)
+	}
+	slog.Info("Testing if CA Certificate is existing")
+	ca, e := getTenantCA(client)
+	if e != nil || ca == nil {
+		slog.Error("Error while requesting certificate. Is the CA certificate created in tenant "+tenantID+"? Exiting now.", "error", e)
+		os.Exit(exitCodePrerequisitesNotFulfilled)
+	}
+
+	slog.Info("Testing if device is registered already", "deviceID", deviceID)
+	state, e := getRegistrationState(client, deviceID, nil, deviceIdentityType)
+	if e != nil {
+		slog.Error("Error while retrieving registration state. Exiting now.", "error", e, "deviceID", deviceID)
+		os.Exit(exitCodeGeneralProcessingError)
+	}
+	if state.Enrollment != enrollmentStateNotRegistered {
+		slog.Error("Device is registered already. Decommission it before processing a new request. Exiting now.", "deviceID", deviceID,
+			"request", state.RequestStatus, "enrollment", state.Enrollment)
+		os.Exit(exitCodePrerequisitesNotFulfilled)
+	}
+
+	journal := newRollbackJournal(false)
+	slog.Info("Creating bulk registration request for device-id", "deviceID", deviceID)
+	if e := createJournaledRegistrationRequest(client, deviceID, otp, journal); e != nil {
+		slog.Error("Error while creating bulk registration request. Exiting now.", "error", e, "deviceID", deviceID)
+		journal.exit(exitCodeGeneralProcessingError)
+	}
+
+	slog.Info("Enrolling Device", "deviceID", deviceID)
+	certPEM, e := enrollDevice(client, deviceID, otp, csr)
+	if e != nil {
+		slog.Error("Error while enrolling device", "error", e)
+		journal.exit(exitCodeGeneralProcessingError)
+	}
+
+	response := enrollmentResponse{
+		DeviceID:    deviceID,
+		Certificate: string(certPEM),
+		C8yHost:     g.C8yHost,
+		TenantID:    tenantID,
+		CreatedAt:   time.Now().UTC().Format(time.RFC3339),
+	}
+	if caCert, err := parseTrustedCertificate(ca); err == nil {
+		response.CACertificate = string(certutil.MarshalCertificateToPEM(caCert.Raw))
+	} else {
+		slog.Warn("Error while parsing tenant CA certificate. Response bundle won't contain it.", "error", err)
+	}
+	payload, _ := json.Marshal(response)
+	fileName := valueOrDefault(g.Output, fmt.Sprintf(fileNameTemplateResponseBundle, deviceID))
+	if e := writeEnrollmentBundle(enrollmentBundle{Type: bundleTypeEnrollmentResponse, Payload: base64.StdEncoding.EncodeToString(payload)}, fileName); e != nil {
+		// the certificate is issued already, the request can't be processed again with the same one-time password
+		slog.Error("Error while writing response bundle. Exiting now.", "error", e, "fileName", fileName)
+		os.Exit(exitCodeGeneralProcessingError)
+	}
+	slog.Info(fmt.Sprintf("Placed response bundle '%s'. Transfer it to the device and run '%s import'.", fileName, offlineEnrollmentCmdName), "deviceID", deviceID)
+	return nil
+}
+
+func (g *CmdOfflineEnrollmentImport) Execute(args []string) error {
+	slog.Info(fmt.Sprintf("Started %s import with arguments: Response=%s PrivateKey=%s", offlineEnrollmentCmdName, g.Response, g.PrivateKey))
+
+	response := enrollmentResponse{}
+	if _, e := readEnrollmentBundle(g.Response, bundleTypeEnrollmentResponse, &response); e != nil {
+		slog.Error("Error while reading response bundle. Exiting now.", "error", e, "fileName", g.Response)
+		os.Exit(exitCodePrerequisitesNotFulfilled)
+	}
+	deviceID := response.DeviceID
+	cert, e := certutil.ParseCertificatePEM([]byte(response.Certificate))
+	if e != nil {
+		slog.Error("Error while parsing certificate of response bundle. Exiting now.", "error", e, "deviceID", deviceID)
+		os.Exit(exitCodePrerequisitesNotFulfilled)
+	}
+	privateKeyFileName := valueOrDefault(g.PrivateKey, fmt.Sprintf(fileNameTemplatePrivateKey, deviceID))
+	if _, e := readSigningKey(privateKeyFileName, cert); e != nil {
+		slog.Error("Certificate does not match the private key of the device. Exiting now.", "error", e, "fileName", privateKeyFileName)
+		os.Exit(exitCodePrerequisitesNotFulfilled)
+	}
+	if len(response.CACertificate) > 0 {
+		if e := verifyIssuedBy(cert, []byte(response.CACertificate)); e != nil {
+			slog.Error("Certificate is not issued by the tenant CA of the response bundle. Exiting now.", "error", e, "deviceID", deviceID)
+			os.Exit(exitCodePrerequisitesNotFulfilled)
+		}
+	}
+
+	certFileName := fmt.Sprintf(fileNameTemplateCertificate, deviceID)
+	if e := writeToFile(response.Certificate, certFileName); e != nil {
+		slog.Error("Error while writing file. Exiting now.", "error", e, "fileName", certFileName)
+		os.Exit(exitCodeGeneralProcessingError)
+	}
+	slog.Info(fmt.Sprintf("Certificate import succeeded. Placed file '%s' in current working directory.", certFileName),
+		"deviceID", deviceID, "c8yHost", response.C8yHost, "tenantId", response.TenantID, "notAfter", cert.NotAfter.Format(time.RFC3339))
+	return nil
+}
+
+// Reads a request bundle and verifies it: the CSR must be valid, belong to the device and its key must have signed the bundle
+func readEnrollmentRequest(fileName string) (*enrollmentRequest, *x509.CertificateRequest, error) {
+	request := &enrollmentRequest{}
+	bundle, err := readEnrollmentBundle(fileName, bundleTypeEnrollmentRequest, request)
+	if err != nil {
+		return nil, nil, err
+	}
+	csr, err := parseCertificateSigningRequestPEM([]byte(request.CSR))
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid certificate signing request: %w", err)
+	}
+	if csr.Subject.CommonName != request.DeviceID {
+		return nil, nil, fmt.Errorf("common name '%s' of the CSR does not match device ID '%s'", csr.Subject.CommonName, request.DeviceID)
+	}
+	if len(request.OneTimePassword) == 0 {
+		return nil, nil, errors.New("request bundle contains no one-time password")
+	}
+	payload, _ := base64.StdEncoding.DecodeString(bundle.Payload)
+	if err := verifySHA256Signature(csr.PublicKey, payload, bundle.Signature); err != nil {
+		return nil, nil, fmt.Errorf("request bundle is not signed by the key of the CSR: %w", err)
+	}
+	return request, csr, nil
+}
+
+// Reads a bundle of the given type and decodes its payload
+func readEnrollmentBundle(fileName string, bundleType string, payload any) (*enrollmentBundle, error) {
+	contents, err := readFromFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	bundle := &enrollmentBundle{}
+	if err := json.Unmarshal(contents, bundle); err != nil {
+		return nil, fmt.Errorf("invalid bundle: %w", err)
+	}
+	if bundle.Type != bundleType {
+		return nil, fmt.Errorf("expected bundle of type '%s', got '%s'", bundleType, bundle.Type)
+	}
+	decoded, err := base64.StdEncoding.DecodeString(bundle.Payload)
+	if err != nil {
+		return nil, fmt.Errorf("bundle payload is not base64 encoded: %w", err)
+	}
+	if err := json.Unmarshal(decoded, payload); err != nil {
+		return nil, fmt.Errorf("invalid bundle payload: %w", err)
+	}
+	return bundle, nil
+}
+
+func writeEnrollmentBundle(bundle enrollmentBundle, fileName string) error {
+	contents, err := json.MarshalIndent(bundle, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeToFile(string(contents)+"\n", fileName)
+}
+
+// Verifies that a client certificate is issued by the CA certificate (PEM)
+func verifyIssuedBy(cert *x509.Certificate, caPEM []byte) error {
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(caPEM) {
+		return errors.New("no CA certificate found")
+	}
+	_, err := cert.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}})
+	return err
+}
@@ -3,27 +3,35 @@ package main
 import (
 	"context"
 	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"log/slog"
 	"os"
+	"time"
 
 	"github.com/reubenmiller/go-c8y/pkg/c8y"
 	"github.com/reubenmiller/go-c8y/pkg/certutil"
 )
 
 type CmdGroupRenewCert struct {
-	C8yHost            string `long:"cumulocity-host" description:"Provide platform endpoint, e.g. 'https://iot.eu-latest.cumulocity.com'" required:"true"`
-	CertificateFile    string `long:"current-certificate" description:"File path to your certificate pem" required:"true"`
-	PrivateKeyFile     string `long:"private-key" description:"File path to your private key pem" required:"true"`
-	NewCertificateName string `long:"new-certificate-name" description:"Filename of the new certificate" required:"true"`
+	C8yHost            string        `long:"cumulocity-host" description:"Provide platform endpoint, e.g. 'https://iot.eu-latest.cumulocity.com'" required:"true"`
+	CertificateFile    string        `long:"current-certificate" description:"File path to your certificate pem" required:"true"`
+	PrivateKeyFile     string        `long:"private-key" description:"File path to your private key pem" required:"true"`
+	NewCertificateName string        `long:"new-certificate-name" description:"Filename of the new certificate" required:"true"`
+	PublishInfo        bool          `long:"publish-certificate-info" description:"Update the c8y_CertificateInfo fragment of the device managed object and create a c8y_CertificateRenewed event after renewal"`
+	IdentityType       string        `long:"identity-type" description:"Type of the external ID the device managed object is looked up with (--publish-certificate-info, --raise-alarms)" default:"c8y_Serial"`
+	RaiseAlarms        bool          `long:"raise-alarms" description:"Raise an alarm on the device managed object when the renewal fails and clear it after a successful renewal"`
+	CriticalBefore     time.Duration `long:"alarm-critical-before" description:"Alarm severity is CRITICAL when the current certificate expires within this duration" default:"168h"`
+	MajorBefore        time.Duration `long:"alarm-major-before" description:"Alarm severity is MAJOR when the current certificate expires within this duration (MINOR otherwise)" default:"720h"`
 }
 
 var renewCertCmdName = "renewCert"
 var renewCertCmdGroup CmdGroupRenewCert
 
 func (g *CmdGroupRenewCert) Execute(args []string) error {
-	slog.Info(fmt.Sprintf("Started %s with arguments: C8yHost=%s CertFile=%s PrivKeyFile=%s",
-		renewCertCmdName, g.C8yHost, g.CertificateFile, g.PrivateKeyFile))
+	slog.Info(fmt.Sprintf("Started %s with arguments: C8yHost=%s CertFile=%s PrivKeyFile=%s PublishInfo=%t IdentityType=%s RaiseAlarms=%t",
+		renewCertCmdName, g.C8yHost, g.CertificateFile, g.PrivateKeyFile, g.PublishInfo, g.IdentityType, g.RaiseAlarms))
 
 	certPEM, err := readFromFile(g.CertificateFile)
 	if err != nil {
@@ -46,49 +54,103 @@ func (g *CmdGroupRenewCert) Execute(args []string) error {
 		slog.Error("Error while processing certificate and private key. Exiting now.", "error", err)
 		os.Exit(exitCodeGeneralProcessingError)
 	}
-	client := c8y.NewClient(nil, g.C8yHost, "", "", "", false)
-	token, tokenResp, err := client.DeviceEnrollment.RequestAccessToken(context.Background(), &clientCert, nil)
+	client := newC8yClient(g.C8yHost, "", "", "")
+	token, err := requestAccessToken(client, &clientCert)
 	if err != nil {
-		slog.Error("Error while requesting access token", "error", err)
-	}
-	if tokenResp.Response.StatusCode != 200 {
-		slog.Error("Unexpected response code while requesting first access token. Exiting now.", "expectedStatusCode", 200, "receivedStatusCode", tokenResp.Response.StatusCode)
+		slog.Error("Error while requesting access token. Exiting now.", "error", err)
 		os.Exit(exitCodeGeneralProcessingError)
 	}
 
-	key, err := certutil.ParsePrivateKeyPEM(keyPem)
-	if err != nil {
-		slog.Error("Error while parsing private key. Exiting now.", "error", err)
-		os.Exit(exitCodeGeneralProcessingError)
+	var deviceClient *c8y.Client
+	var managedObjectID string
+	if g.PublishInfo || g.RaiseAlarms {
+		deviceClient = newDeviceClient(g.C8yHost, token.AccessToken)
+		mo, err := findDeviceManagedObject(deviceClient, g.IdentityType, cn, deviceUserPrefix+cn)
+		if err == nil && mo == nil {
+			err = errors.New("managed object of the device not found")
+		}
+		if err != nil {
+			slog.Warn("Renewal will not be reported to the platform", "error", err)
+		} else {
+			managedObjectID = mo.ID
+		}
 	}
-	csr, err := client.DeviceEnrollment.CreateCertificateSigningRequest(cn, key)
-	if err != nil {
-		slog.Error("Error while creating certificate signing request. Exiting now.", "error", err)
+	// from here on the current certificate is known to be valid, failures are reported as alarm (--raise-alarms)
+	exitWithRenewalError := func(message string, err error) {
+		slog.Error(message+" Exiting now.", "error", err)
+		if g.RaiseAlarms && len(managedObjectID) > 0 {
+			severity, alarmErr := raiseRenewalAlarm(deviceClient, managedObjectID, clientCert.Leaf, fmt.Sprintf("%s %s", message, err), g.CriticalBefore, g.MajorBefore)
+			if alarmErr != nil {
+				slog.Warn("Error while raising alarm", "error", alarmErr, "managedObjectId", managedObjectID)
+			} else {
+				slog.Info("Raised alarm", "type", certificateRenewalFailedAlarmType, "severity", severity, "managedObjectId", managedObjectID)
+			}
+		}
 		os.Exit(exitCodeGeneralProcessingError)
 	}
-	cert, resp, err := client.DeviceEnrollment.ReEnroll(context.Background(), c8y.ReEnrollOptions{
-		Token: token.AccessToken,
-		CSR:   csr,
-	})
+
+	key, err := certutil.ParsePrivateKeyPEM(keyPem)
 	if err != nil {
-		slog.Error("Error while sending re-enrollment request. Exiting now.", "error", err)
-		os.Exit(exitCodeGeneralProcessingError)
+		exitWithRenewalError("Error while parsing private key.", err)
 	}
-	if resp.Response.StatusCode != 200 {
-		slog.Error("Unexpected response code for re-enrollment request. Exiting now.", "expectedStatusCode", 200, "receivedStatusCode", resp.Response.StatusCode)
-		os.Exit(exitCodeGeneralProcessingError)
+	cert, err := reEnrollCertificate(client, token.AccessToken, cn, key)
+	if err != nil {
+		exitWithRenewalError("Error while renewing certificate.", err)
 	}
 
 	newCertPEM := certutil.MarshalCertificateToPEM(cert.Raw)
 	if len(string(newCertPEM)) == 0 {
-		slog.Error("Error while converting certificate from []byte to PEM format", "error", "PEM length is 0")
-		os.Exit(exitCodeGeneralProcessingError)
+		exitWithRenewalError("Error while converting certificate from []byte to PEM format.", errors.New("PEM length is 0"))
 	}
 
-	writeToFile(string(newCertPEM), g.NewCertificateName)
+	if err := writeToFile(string(newCertPEM), g.NewCertificateName); err != nil {
+		exitWithRenewalError(fmt.Sprintf("Error while writing file '%s'.", g.NewCertificateName), err)
+	}
 
 	slog.Info(fmt.Sprintf("Certificate renewal succeeded. Placed file '%s' in current working directory.",
 		g.NewCertificateName))
 
+	// the renewal succeeded already, so failures when reporting it are only logged
+	if g.PublishInfo && len(managedObjectID) > 0 {
+		if err := publishCertificateInfo(deviceClient, managedObjectID, cert); err != nil {
+			slog.Warn("Error while publishing certificate info to the platform", "error", err, "managedObjectId", managedObjectID)
+		} else {
+			slog.Info("Published certificate info to the platform", "managedObjectId", managedObjectID, "fragment", certificateInfoFragment,
+				"notAfter", cert.NotAfter.Format(time.RFC3339))
+		}
+	}
+	if g.RaiseAlarms && len(managedObjectID) > 0 {
+		if cleared, err := clearRenewalAlarms(deviceClient, managedObjectID); err != nil {
+			slog.Warn("Error while clearing alarms", "error", err, "managedObjectId", managedObjectID)
+		} else if cleared > 0 {
+			slog.Info("Cleared alarms", "type", certificateRenewalFailedAlarmType, "count", cleared, "managedObjectId", managedObjectID)
+		}
+	}
+
 	return nil
 }
+
+// reEnrollCertificate requests a new certificate for the common name and key, authenticated with the access token
+// of the current certificate
+func reEnrollCertificate(client *c8y.Client, accessToken string, cn string, key any) (*x509.Certificate, error) {
+	csr, err := client.DeviceEnrollment.CreateCertificateSigningRequest(cn, key)
+	if err != nil {
+		return nil, fmt.Errorf("error while creating certificate signing request: %w", err)
+	}
+	var cert *x509.Certificate
+	err = withRetry("re-enrollment", func() (*c8y.Response, error) {
+		var resp *c8y.Response
+		cert, resp, err = client.DeviceEnrollment.ReEnroll(context.Background(), c8y.ReEnrollOptions{
+			Token: accessToken,
+			CSR:   csr,
+		})
+		if err == nil && responseStatusCode(resp) != 200 {
+			err = fmt.Errorf("Unexpected response code %d for re-enrollment request. Expected 200.", responseStatusCode(resp))
+		}
+		return resp, err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error while sending re-enrollment request: %w", err)
+	}
+	return cert, nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"time"
+
+	"github.com/reubenmiller/go-c8y/pkg/c8y"
+)
+
+// Alarm raised on the device managed object when a renewal fails while the current certificate is still valid.
+// The platform de-duplicates active alarms of the same type and source (it increases their count), so repeated
+// failures don't flood the alarm list. A successful renewal clears the alarm.
+
+const certificateRenewalFailedAlarmType = "c8y_CertificateRenewalFailed"
+
+// renewalAlarmSeverity returns the severity for the remaining lifetime of the current certificate
+func renewalAlarmSeverity(remaining time.Duration, criticalBefore time.Duration, majorBefore time.Duration) string {
+	switch {
+	case remaining <= criticalBefore:
+		return c8y.AlarmSeverityCritical
+	case remaining <= majorBefore:
+		return c8y.AlarmSeverityMajor
+	default:
+		return c8y.AlarmSeverityMinor
+	}
+}
+
+// raiseRenewalAlarm creates the alarm for the current certificate, the client must be authenticated as the device.
+// Returns the severity of the alarm.
+func raiseRenewalAlarm(client *c8y.Client, managedObjectID string, cert *x509.Certificate, reason string, criticalBefore time.Duration, majorBefore time.Duration) (string, error) {
+	remaining := time.Until(cert.NotAfter)
+	severity := renewalAlarmSeverity(remaining, criticalBefore, majorBefore)
+	text := fmt.Sprintf("Certificate renewal failed: %s Current certificate (serial %s) expires %s (in %s).",
+		reason, serialToHex(cert.SerialNumber), cert.NotAfter.UTC().Format(time.RFC3339), remaining.Round(time.Minute))
+	alarm, _, err := client.Alarm.Create(context.TODO(), map[string]any{
+		"source":   map[string]string{"id": managedObjectID},
+		"type":     certificateRenewalFailedAlarmType,
+		"time":     time.Now().UTC().Format(time.RFC3339),
+		"severity": severity,
+		"text":     text,
+	})
+	if err != nil {
+		return severity, err
+	}
+	// a de-duplicated alarm keeps severity and text of the first failure, so it's escalated explicitly
+	if alarm.Severity != severity {
+		_, _, err = client.Alarm.Update(context.TODO(), alarm.ID, c8y.AlarmUpdateProperties{Severity: severity, Text: text})
+	}
+	return severity, err
+}
+
+// clearRenewalAlarms clears active and acknowledged renewal alarms of the device and returns their number
+func clearRenewalAlarms(client *c8y.Client, managedObjectID string) (int, error) {
+	alarms, _, err := client.Alarm.GetAlarms(context.TODO(), &c8y.AlarmCollectionOptions{
+		Source:            managedObjectID,
+		Type:              certificateRenewalFailedAlarmType,
+		Status:            c8y.AlarmStatusActive + "," + c8y.AlarmStatusAcknowledged,
+		PaginationOptions: c8y.PaginationOptions{PageSize: 100},
+	})
+	if err != nil {
+		return 0, fmt.Errorf("error while retrieving alarms: %w", err)
+	}
+	for i, alarm := range alarms.Alarms {
+		if _, _, err := client.Alarm.Update(context.TODO(), alarm.ID, c8y.AlarmUpdateProperties{Status: c8y.AlarmStatusCleared}); err != nil {
+			return i, fmt.Errorf("error while clearing alarm %s: %w", alarm.ID, err)
+		}
+	}
+	return len(alarms.Alarms), nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+type CmdGroupRequest struct {
+	C8yHost         string        `long:"cumulocity-host" description:"Provide platform endpoint, e.g. 'https://iot.eu-latest.cumulocity.com'" required:"true"`
+	CertificateFile string        `long:"certificate" description:"File path to your certificate" required:"true"`
+	PrivateKeyFile  string        `long:"private-key" description:"File path to your private key" required:"true"`
+	Method          string        `long:"method" description:"HTTP method of the request" default:"GET"`
+	Path            string        `long:"path" description:"Path of the request including the query, e.g. '/inventory/managedObjects?pageSize=5'" required:"true"`
+	Data            string        `long:"data" description:"Optional request body, e.g. a JSON document" required:"false"`
+	DataFile        string        `long:"data-file" description:"Optional file the request body is read from" required:"false"`
+	Headers         []string      `long:"header" description:"Additional request header 'Name: value' (can be repeated)" required:"false"`
+	Include         bool          `long:"include" description:"Print status line and response headers before the body"`
+	Cache           bool          `long:"cache" description:"Reuse a still valid access token (see getAccessToken --cache)"`
+	CacheDir        string        `long:"cache-dir" description:"Directory of the token cache. Optional (user cache directory when missing)" required:"false"`
+	RefreshBefore   time.Duration `long:"refresh-before" description:"Cached tokens expiring within this duration are refreshed" default:"5m"`
+}
+
+var requestCmdName = "request"
+var requestCmdGroup CmdGroupRequest
+
+func (g *CmdGroupRequest) Execute(args []string) error {
+	slog.Info(fmt.Sprintf("Started %s with arguments: C8yHost=%s CertFile=%s PrivKeyFile=%s Method=%s Path=%s DataFile=%s Headers=%v Cache=%t",
+		requestCmdName, g.C8yHost, g.CertificateFile, g.PrivateKeyFile, g.Method, g.Path, g.DataFile, g.Headers, g.Cache))
+
+	if len(g.Data) > 0 && len(g.DataFile) > 0 {
+		slog.Error("Provide either --data or --data-file, not both. Exiting now.")
+		os.Exit(exitCodePrerequisitesNotFulfilled)
+	}
+	var body []byte
+	if len(g.Data) > 0 {
+		body = []byte(g.Data)
+	} else if len(g.DataFile) > 0 {
+		content, err := readFromFile(g.DataFile)
+		if err != nil {
+			slog.Error("Error when reading file. Exiting now.", "error", err, "fileName", g.DataFile)
+			os.Exit(exitCodeGeneralProcessingError)
+		}
+		body = content
+	}
+	requestURL, err := url.Parse(g.Path)
+	if err != nil {
+		slog.Error("Invalid request path. Exiting now.", "error", err, "path", g.Path)
+		os.Exit(exitCodePrerequisitesNotFulfilled)
+	}
+
+	clientCert := readClientCertificateOrExit(g.CertificateFile, g.PrivateKeyFile)
+	cache := newTokenCacheOrExit(g.Cache, g.CacheDir)
+	token, _, err := obtainAccessToken(g.C8yHost, &clientCert, cache, g.RefreshBefore)
+	if err != nil {
+		slog.Error("Error while requesting access token. Exiting now.", "error", err)
+		os.Exit(exitCodeGeneralProcessingError)
+	}
+	client := newDeviceClient(g.C8yHost, token.AccessToken)
+
+	var reqBody any
+	if body != nil {
+		reqBody = body
+	}
+	req, err := client.NewRequest(strings.ToUpper(g.Method), requestURL.Path, requestURL.RawQuery, reqBody)
+	if err != nil {
+		slog.Error("Error while creating request. Exiting now.", "error", err)
+		os.Exit(exitCodePrerequisitesNotFulfilled)
+	}
+	for _, header := range g.Headers {
+		name, value, found := strings.Cut(header, ":")
+		if !found {
+			slog.Error("Invalid header, expected 'Name: value'. Exiting now.", "header", header)
+			os.Exit(exitCodePrerequisitesNotFulfilled)
+		}
+		req.Header.Set(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+
+	resp, err := client.Do(context.Background(), req, nil)
+	if resp == nil {
+		slog.Error("Error while sending request. Exiting now.", "error", err)
+		os.Exit(exitCodeGeneralProcessingError)
+	}
+	if g.Include {
+		fmt.Printf("%s %s\n", resp.Proto(), resp.Status())
+		for _, name := range slices.Sorted(maps.Keys(resp.Header())) {
+			for _, value := range resp.Header().Values(name) {
+				fmt.Printf("%s: %s\n", name, value)
+			}
+		}
+		fmt.Println()
+	}
+	if responseBody := resp.Body(); len(responseBody) > 0 {
+		fmt.Print(string(responseBody))
+		if !strings.HasSuffix(string(responseBody), "\n") {
+			fmt.Println()
+		}
+	}
+	if !resp.IsSuccess() {
+		slog.Error("Request failed", "status", resp.StatusCode(), "method", req.Method, "path", requestURL.Path)
+		os.Exit(exitCodeGeneralProcessingError)
+	}
+	slog.Info("Request succeeded", "status", resp.StatusCode(), "duration", resp.Duration().Round(time.Millisecond))
+	return nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/reubenmiller/go-c8y/pkg/c8y"
+)
+
+// Retry policy shared by all requests towards the platform which are worth repeating (enrollment, re-enrollment,
+// access token and bulk registration). Only network errors and 5xx responses are retried, 4xx responses fail fast.
+type retryPolicy struct {
+	MaxAttempts  int
+	InitialDelay time.Duration
+	MaxDelay     time.Duration
+	Deadline     time.Duration
+}
+
+// Returns the retry policy configured via global options
+func currentRetryPolicy() retryPolicy {
+	return retryPolicy{
+		MaxAttempts:  globalOptions.RetryMaxAttempts,
+		InitialDelay: globalOptions.RetryInitialDelay,
+		MaxDelay:     globalOptions.RetryMaxDelay,
+		Deadline:     globalOptions.RetryDeadline,
+	}
+}
+
+// Returns the backoff before the given (1-based) retry: exponential growth capped by MaxDelay (no cap when 0), with
+// jitter in the upper half of the interval so that many devices don't retry in lockstep.
+func (p retryPolicy) backoff(retry int) time.Duration {
+	delay := p.InitialDelay
+	for i := 1; i < retry; i++ {
+		if p.MaxDelay > 0 && delay >= p.MaxDelay || delay > math.MaxInt64/2 {
+			break
+		}
+		delay *= 2
+	}
+	if p.MaxDelay > 0 && delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	if delay <= 0 {
+		return 0
+	}
+	half := delay / 2
+	return half + rand.N(half+1)
+}
+
+// Executes the request until it succeeds, fails with a non retryable error, attempts are exhausted or the
+// deadline is exceeded.
+func withRetry(name string, request func() (*c8y.Response, error)) error {
+	policy := currentRetryPolicy()
+	startedAt := time.Now()
+	attempt := 0
+	for {
+		attempt++
+		resp, err := request()
+		statusCode := responseStatusCode(resp)
+		if err == nil {
+			if attempt > 1 {
+				slog.Info(fmt.Sprintf("Request '%s' succeeded", name), "attempt", attempt, "statusCode", statusCode)
+			}
+			return nil
+		}
+		if !isRetryable(resp, err) {
+			return fmt.Errorf("%s failed with non-retryable status %d: %w", name, statusCode, err)
+		}
+		if attempt >= policy.MaxAttempts {
+			return fmt.Errorf("giving up %s after %d attempts: %w", name, attempt, err)
+		}
+		delay := policy.backoff(attempt)
+		if policy.Deadline > 0 && time.Since(startedAt)+delay > policy.Deadline {
+			return fmt.Errorf("giving up %s after %d attempts, retry deadline of %s exceeded: %w", name, attempt, policy.Deadline, err)
+		}
+		slog.Warn(fmt.Sprintf("Error while %s. Retrying in %s.", name, delay.Round(time.Millisecond)),
+			"statusCode", statusCode, "error", err, "attempt", attempt, "maxAttempts", policy.MaxAttempts)
+		time.Sleep(delay)
+	}
+}
+
+// Network errors (no response) and server errors are worth retrying, client errors are not. TLS errors without
+// response fail fast as well, retrying doesn't help against a rejected client certificate or an untrusted server.
+func isRetryable(resp *c8y.Response, err error) bool {
+	if errors.Is(err, context.Canceled) || isPermanentTransportError(err) {
+		return false
+	}
+	statusCode := responseStatusCode(resp)
+	return statusCode == 0 || statusCode >= http.StatusInternalServerError
+}
+
+// Returns true for TLS errors which a retry can't fix: alerts of the server (e.g. revoked client certificate) and
+// failed verification of the server certificate
+func isPermanentTransportError(err error) bool {
+	var verificationErr *tls.CertificateVerificationError
+	var recordHeaderErr tls.RecordHeaderError
+	var unknownAuthorityErr x509.UnknownAuthorityError
+	var certificateInvalidErr x509.CertificateInvalidError
+	var hostnameErr x509.HostnameError
+	return isTLSAlert(err) ||
+		errors.As(err, &verificationErr) ||
+		errors.As(err, &recordHeaderErr) ||
+		errors.As(err, &unknownAuthorityErr) ||
+		errors.As(err, &certificateInvalidErr) ||
+		errors.As(err, &hostnameErr)
+}
+
+// Returns the status code of a response, or 0 if no response was received
+func responseStatusCode(resp *c8y.Response) int {
+	if resp == nil || resp.Response == nil {
+		return 0
+	}
+	return resp.Response.StatusCode
+}
+
+// Requests a device access token using the client certificate (with retries)
+func requestAccessToken(client *c8y.Client, clientCert *tls.Certificate) (*c8y.AccessToken, error) {
+	var token *c8y.AccessToken
+	err := withRetry("requesting access token", func() (*c8y.Response, error) {
+		var resp *c8y.Response
+		var err error
+		token, resp, err = newCertificateClient(client, clientCert).DeviceEnrollment.RequestAccessToken(context.Background(), nil, nil)
+		if err == nil && responseStatusCode(resp) != http.StatusOK {
+			err = fmt.Errorf("unexpected response code while requesting access token. Expected 200, received %d", responseStatusCode(resp))
+		}
+		return resp, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+// Returns true if the error is a TLS alert sent by the server, e.g. because it rejected the client certificate. With
+// TLS 1.3 the server verifies the client certificate after the client finished its handshake, so the alert shows up
+// with the first read instead of failing the handshake.
+func isTLSAlert(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "remote error"
+}
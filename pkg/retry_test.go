@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/reubenmiller/go-c8y/pkg/c8y"
+)
+
+func TestIsRetryable(t *testing.T) {
+	response := func(statusCode int) *c8y.Response {
+		return &c8y.Response{Response: &http.Response{StatusCode: statusCode}}
+	}
+	tests := []struct {
+		name string
+		resp *c8y.Response
+		err  error
+		want bool
+	}{
+		{"connection refused", nil, &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}, true},
+		{"timeout", nil, context.DeadlineExceeded, true},
+		{"internal server error", response(http.StatusInternalServerError), errors.New("500"), true},
+		{"service unavailable", response(http.StatusServiceUnavailable), errors.New("503"), true},
+		{"unauthorized", response(http.StatusUnauthorized), errors.New("401"), false},
+		{"not found", response(http.StatusNotFound), errors.New("404"), false},
+		{"conflict", response(http.StatusConflict), errors.New("409"), false},
+		{"canceled", nil, fmt.Errorf("request: %w", context.Canceled), false},
+		{"tls alert of server", nil, &net.OpError{Op: "remote error", Err: errors.New("tls: certificate required")}, false},
+		{"unknown authority", nil, fmt.Errorf("Post: %w", x509.UnknownAuthorityError{}), false},
+		{"certificate verification", nil, &tls.CertificateVerificationError{Err: x509.CertificateInvalidError{Reason: x509.Expired}}, false},
+		{"hostname mismatch", nil, x509.HostnameError{Host: "example.org", Certificate: &x509.Certificate{}}, false},
+		{"no tls server", nil, tls.RecordHeaderError{Msg: "first record does not look like a TLS handshake"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isRetryable(tt.resp, tt.err); got != tt.want {
+				t.Errorf("isRetryable() = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  retryPolicy
+		retry   int
+		wantMin time.Duration
+		wantMax time.Duration
+	}{
+		{"first retry", retryPolicy{InitialDelay: time.Second, MaxDelay: 30 * time.Second}, 1, 500 * time.Millisecond, time.Second},
+		{"doubled per retry", retryPolicy{InitialDelay: time.Second, MaxDelay: 30 * time.Second}, 3, 2 * time.Second, 4 * time.Second},
+		{"capped by maximum delay", retryPolicy{InitialDelay: time.Second, MaxDelay: 30 * time.Second}, 10, 15 * time.Second, 30 * time.Second},
+		{"no maximum delay", retryPolicy{InitialDelay: time.Second}, 10, 256 * time.Second, 512 * time.Second},
+		{"no overflow without maximum delay", retryPolicy{InitialDelay: time.Second}, 100, time.Duration(1) << 61, time.Duration(1<<63 - 1)},
+		{"no initial delay", retryPolicy{MaxDelay: 30 * time.Second}, 3, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for range 20 {
+				if got := tt.policy.backoff(tt.retry); got < tt.wantMin || got > tt.wantMax {
+					t.Fatalf("backoff(%d) = %s, want between %s and %s", tt.retry, got, tt.wantMin, tt.wantMax)
+				}
+			}
+		})
+	}
+}
+
+// TestRequestAccessTokenRetries counts the connections to the access token endpoint: every attempt uses a new one
+func TestRequestAccessTokenRetries(t *testing.T) {
+	tests := []struct {
+		name         string
+		clientAuth   tls.ClientAuthType
+		statusCode   int
+		wantAttempts int32
+		wantErr      string
+	}{
+		{"server error is retried", tls.RequireAnyClientCert, http.StatusServiceUnavailable, 3, "giving up"},
+		{"rejected credentials fail fast", tls.RequireAnyClientCert, http.StatusUnauthorized, 1, "non-retryable status 401"},
+		{"rejected client certificate fails fast", tls.RequireAndVerifyClientCert, http.StatusOK, 1, "non-retryable status 0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			platform := startTestPlatform(t)
+			_, _, clientCert := platform.writeDeviceCertificate(t, t.TempDir(), "retry-device")
+
+			var attempts atomic.Int32
+			server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				writeMockError(w, tt.statusCode, "devicecontrol/Test", http.StatusText(tt.statusCode))
+			}))
+			server.TLS = platform.mtlsTLSConfig()
+			// without client CAs, verified client certificates are rejected
+			server.TLS.ClientAuth = tt.clientAuth
+			server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+				if state == http.StateNew {
+					attempts.Add(1)
+				}
+			}
+			server.StartTLS()
+			t.Cleanup(server.Close)
+			routeAccessTokenEndpoint(t, server.Listener.Addr().String())
+			setRetryPolicy(t, retryPolicy{MaxAttempts: 3, InitialDelay: time.Millisecond, MaxDelay: time.Millisecond})
+
+			_, err := requestAccessToken(platform.adminClient(), &clientCert)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("requestAccessToken() error = %v, want error containing %q", err, tt.wantErr)
+			}
+			if got := attempts.Load(); got != tt.wantAttempts {
+				t.Errorf("attempts = %d, want %d", got, tt.wantAttempts)
+			}
+		})
+	}
+}
+
+// setRetryPolicy sets the retry options until the end of the test
+func setRetryPolicy(t *testing.T, policy retryPolicy) {
+	previous := globalOptions
+	globalOptions.RetryMaxAttempts = policy.MaxAttempts
+	globalOptions.RetryInitialDelay = policy.InitialDelay
+	globalOptions.RetryMaxDelay = policy.MaxDelay
+	globalOptions.RetryDeadline = policy.Deadline
+	t.Cleanup(func() { globalOptions = previous })
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/reubenmiller/go-c8y/pkg/c8y"
+	"github.com/reubenmiller/go-c8y/pkg/certutil"
+)
+
+type CmdGroupRevokeCertificate struct {
+	C8yHost         string        `long:"cumulocity-host" description:"Provide platform endpoint, e.g. 'https://iot.eu-latest.cumulocity.com'" required:"true"`
+	C8yTenantId     string        `long:"cumulocity-tenant-id" description:"Provide platform tenand id, e.g. 't4009123'. Optional (resolved from host when missing)" required:"false"`
+	C8yUser         string        `long:"cumulocity-user" description:"Provide your platform user, e.g. 'john.doe@example.org'" required:"true"`
+	C8yPassword     string        `long:"cumulocity-password" description:"Provide your platform users password, e.g. 'aVerySecretPass1337'" required:"true"`
+	CertificateFile string        `long:"certificate" description:"File path of the certificate to revoke"`
+	Serial          string        `long:"serial" description:"Serial number (hex) of the certificate to revoke, e.g. '4F:1A:09'"`
+	DeviceId        string        `long:"device-id" description:"Revoke the certificate of this device (read from c8y-certificate-<device-id>.pem)"`
+	PrivateKeyFile  string        `long:"private-key" description:"Private key of the certificate. Used to verify that access tokens are rejected after revocation (default for --device-id: c8y-private-key-<device-id>.pem)"`
+	VerifyTimeout   time.Duration `long:"verify-timeout" description:"Time to wait for the platform to reject the revoked certificate" default:"1m"`
+}
+
+var revokeCertificateCmdName = "revokeCert"
+var revokeCertificateCmdGroup CmdGroupRevokeCertificate
+
+// Entry of the certificate revocation list of the tenant
+type revokedCertificate struct {
+	SerialNumberInHex string `json:"serialNumberInHex"`
+	RevocationDate    string `json:"revocationDate,omitempty"`
+}
+
+func (g *CmdGroupRevokeCertificate) Execute(args []string) error {
+	slog.Info(fmt.Sprintf("Started %s with arguments: C8yHost=%s C8yTenantId=%s C8yUser=%s C8yPassword=%s CertificateFile=%s Serial=%s DeviceId=%s PrivateKeyFile=%s",
+		revokeCertificateCmdName, g.C8yHost, g.C8yTenantId, g.C8yUser, "{obfuscated}", g.CertificateFile, g.Serial, g.DeviceId, g.PrivateKeyFile))
+
+	certificateFile, privateKeyFile := g.CertificateFile, g.PrivateKeyFile
+	if len(g.DeviceId) > 0 {
+		certificateFile = valueOrDefault(certificateFile, fmt.Sprintf(fileNameTemplateCertificate, g.DeviceId))
+		privateKeyFile = valueOrDefault(privateKeyFile, fmt.Sprintf(fileNameTemplatePrivateKey, g.DeviceId))
+	}
+	if len(certificateFile) == 0 && len(g.Serial) == 0 {
+		slog.Error("Provide the certificate to revoke with --certificate, --serial or --device-id. Exiting now.")
+		os.Exit(exitCodePrerequisitesNotFulfilled)
+	}
+
+	var cert *x509.Certificate
+	serial := normalizeSerial(g.Serial)
+	if len(certificateFile) > 0 {
+		var e error
+		if cert, e = readCertificateFile(certificateFile); e != nil {
+			slog.Error("Error while reading certificate. Exiting now.", "error", e, "fileName", certificateFile)
+			os.Exit(exitCodePrerequisitesNotFulfilled)
+		}
+		if len(serial) > 0 && serial != serialToHex(cert.SerialNumber) {
+			slog.Error("Serial number does not match the certificate. Exiting now.", "serial", serial, "certificateSerial", serialToHex(cert.SerialNumber))
+			os.Exit(exitCodePrerequisitesNotFulfilled)
+		}
+		serial = serialToHex(cert.SerialNumber)
+	}
+	if _, ok := new(big.Int).SetString(serial, 16); !ok {
+		slog.Error("Invalid serial number. Exiting now.", "serial", g.Serial)
+		os.Exit(exitCodePrerequisitesNotFulfilled)
+	}
+
+	tenantID := resolveTenantIDOrExit(g.C8yHost, g.C8yTenantId, g.C8yUser, g.C8yPassword)
+	client := newC8yClient(g.C8yHost, tenantID, g.C8yUser, g.C8yPassword)
+
+	if cert != nil {
+		slog.Info("Revoking certificate", "serial", serial, "subject", cert.Subject.String(), "issuer", cert.Issuer.String(),
+			"fingerprint", certificateFingerprint(cert), "notAfter", cert.NotAfter.Format(time.RFC3339), "revokedBy", g.C8yUser)
+	} else {
+		slog.Info("Revoking certificate", "serial", serial, "revokedBy", g.C8yUser)
+	}
+	if e := revokeCertificate(client, serial, time.Now()); e != nil {
+		slog.Error("Error while revoking certificate. Exiting now.", "error", e, "serial", serial)
+		os.Exit(exitCodeGeneralProcessingError)
+	}
+	slog.Info("Certificate added to the certificate revocation list of tenant "+tenantID, "serial", serial)
+
+	if cert == nil || len(privateKeyFile) == 0 {
+		slog.Warn("Certificate or private key not provided. Skipping verification that access tokens are rejected.", "serial", serial)
+		return nil
+	}
+	clientCert, e := tls.LoadX509KeyPair(certificateFile, privateKeyFile)
+	if e != nil {
+		slog.Warn("Error while loading certificate and private key. Skipping verification that access tokens are rejected.", "error", e)
+		return nil
+	}
+	if e := verifyAccessTokenRejected(newC8yClient(g.C8yHost, "", "", ""), &clientCert, g.VerifyTimeout); e != nil {
+		slog.Error("Revoked certificate is still accepted by the platform. Exiting now.", "error", e, "serial", serial)
+		os.Exit(exitCodeGeneralProcessingError)
+	}
+	slog.Info("Verified that access token requests with the revoked certificate are rejected", "serial", serial)
+	return nil
+}
+
+// Adds a certificate to the certificate revocation list of the tenant
+func revokeCertificate(client *c8y.Client, serialInHex string, revocationDate time.Time) error {
+	_, err := client.SendRequest(context.TODO(), c8y.RequestOptions{
+		Method: "PUT",
+		Path:   "tenant/trusted-certificates/settings/crl",
+		Body: map[string][]revokedCertificate{
+			"crls": {{SerialNumberInHex: serialInHex, RevocationDate: revocationDate.UTC().Format(time.RFC3339)}},
+		},
+	})
+	return err
+}
+
+// Requests access tokens until the platform rejects the certificate (it might take a moment until the
+// revocation list is applied) or the timeout is exceeded. The platform rejects either the access token request
+// (401/403) or the client certificate during the TLS handshake of the mTLS endpoint.
+func verifyAccessTokenRejected(client *c8y.Client, clientCert *tls.Certificate, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		_, resp, err := newCertificateClient(client, clientCert).DeviceEnrollment.RequestAccessToken(context.TODO(), nil, nil)
+		statusCode := responseStatusCode(resp)
+		if statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden {
+			slog.Info("Access token request rejected", "statusCode", statusCode)
+			return nil
+		}
+		if isTLSAlert(err) {
+			slog.Info("Client certificate rejected during TLS handshake", "error", err)
+			return nil
+		}
+		if err == nil {
+			err = errors.New("access token was issued")
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("certificate not rejected within %s (last statusCode=%d): %w", timeout, statusCode, err)
+		}
+		slog.Info("Certificate not rejected yet. Retrying in 5s.", "statusCode", statusCode, "error", err)
+		time.Sleep(5 * time.Second)
+	}
+}
+
+func readCertificateFile(fileName string) (*x509.Certificate, error) {
+	certPEM, err := readFromFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	return certutil.ParseCertificatePEM(certPEM)
+}
+
+// Returns the serial number in the hex format of the revocation list (upper case, no separators)
+func serialToHex(serial *big.Int) string {
+	return strings.ToUpper(serial.Text(16))
+}
+
+// Normalizes a serial number given by the user, e.g. '0x4f:1a:09' to '4F1A09'
+func normalizeSerial(serial string) string {
+	serial = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(serial)), "0x")
+	serial = strings.NewReplacer(":", "", " ", "", "-", "").Replace(serial)
+	serial = strings.TrimLeft(serial, "0")
+	return strings.ToUpper(serial)
+}
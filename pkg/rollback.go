@@ -0,0 +1,58 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+)
+
+// A rollback journal tracks the objects created during a run (on the platform and locally), so that a failed
+// run can undo them instead of leaving e.g. a registration request with a valid one-time password behind.
+type rollbackJournal struct {
+	keep  bool
+	steps []rollbackStep
+}
+
+type rollbackStep struct {
+	description string
+	undo        func() error
+}
+
+// keep=true only reports the objects remaining after a failure, without removing them
+func newRollbackJournal(keep bool) *rollbackJournal {
+	return &rollbackJournal{keep: keep}
+}
+
+// add registers an object created by the run together with the function removing it again
+func (j *rollbackJournal) add(description string, undo func() error) {
+	j.steps = append(j.steps, rollbackStep{description: description, undo: undo})
+}
+
+// rollback undoes all steps in reverse order. Objects which could not be removed are reported.
+func (j *rollbackJournal) rollback() {
+	if len(j.steps) == 0 {
+		return
+	}
+	remaining := []string{}
+	for i := len(j.steps) - 1; i >= 0; i-- {
+		step := j.steps[i]
+		if j.keep {
+			remaining = append(remaining, step.description)
+			continue
+		}
+		slog.Info("Rolling back " + step.description)
+		if err := step.undo(); err != nil {
+			slog.Error("Error while rolling back "+step.description, "error", err)
+			remaining = append(remaining, step.description)
+		}
+	}
+	j.steps = nil
+	for _, description := range remaining {
+		slog.Warn("Remains after failed run: " + description)
+	}
+}
+
+// exit rolls back and terminates the program with the exit code
+func (j *rollbackJournal) exit(code int) {
+	j.rollback()
+	os.Exit(code)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+type CmdGroupServeMock struct {
+	ListenAddress     string        `long:"listen-address" description:"Address the mock platform listens on" default:"127.0.0.1"`
+	Port              int           `long:"port" description:"Port of the REST API (HTTPS)" default:"4443"`
+	MtlsPort          int           `long:"mtls-port" description:"Port of the certificate based device access token endpoint. Clients always expect 8443." default:"8443"`
+	MqttPort          int           `long:"mqtt-port" description:"Port of the MQTT stand-in (TLS with device certificate), 0 disables it" default:"8883"`
+	TenantId          string        `long:"tenant-id" description:"Tenant id reported by the mock platform" default:"t12345"`
+	User              string        `long:"user" description:"User accepted by the mock platform" default:"admin"`
+	Password          string        `long:"password" description:"Password accepted by the mock platform" default:"admin"`
+	Validity          time.Duration `long:"certificate-validity" description:"Validity of issued device certificates, e.g. '8760h'" default:"8760h"`
+	CaCertificateFile string        `long:"write-ca-certificate" description:"Optional file path the generated CA certificate is written to (PEM)" required:"false"`
+	CaValidity        time.Duration `long:"ca-validity" description:"Validity of the generated (and renewed) tenant CA certificate" default:"87600h"`
+	WithoutTenantCA   bool          `long:"without-tenant-ca" description:"Start without tenant CA, until it is created via the API (enrollment fails until then)"`
+}
+
+var serveMockCmdName = "serveMock"
+var serveMockCmdGroup CmdGroupServeMock
+
+func (g *CmdGroupServeMock) Execute(args []string) error {
+	slog.Info(fmt.Sprintf("Started %s with arguments: ListenAddress=%s Port=%d MtlsPort=%d MqttPort=%d TenantId=%s User=%s Password=%s",
+		serveMockCmdName, g.ListenAddress, g.Port, g.MtlsPort, g.MqttPort, g.TenantId, g.User, "{obfuscated}"))
+
+	platform, err := newMockPlatform(g.ListenAddress, g.TenantId, g.User, g.Password, g.Validity, g.CaValidity)
+	if err != nil {
+		slog.Error("Error while creating mock platform. Exiting now.", "error", err)
+		os.Exit(exitCodeGeneralProcessingError)
+	}
+	platform.caPublished = !g.WithoutTenantCA
+	if len(g.CaCertificateFile) > 0 {
+		if err := writeToFile(string(platform.caCertificatePEM()), g.CaCertificateFile); err != nil {
+			slog.Error("Error while writing CA certificate. Exiting now.", "error", err, "fileName", g.CaCertificateFile)
+			os.Exit(exitCodeGeneralProcessingError)
+		}
+		slog.Info("Placed CA certificate of mock platform", "fileName", g.CaCertificateFile)
+	}
+
+	apiServer := &http.Server{
+		Addr:      net.JoinHostPort(g.ListenAddress, strconv.Itoa(g.Port)),
+		Handler:   platform.apiHandler(),
+		TLSConfig: platform.apiTLSConfig(),
+	}
+	mtlsServer := &http.Server{
+		Addr:      net.JoinHostPort(g.ListenAddress, strconv.Itoa(g.MtlsPort)),
+		Handler:   platform.mtlsHandler(),
+		TLSConfig: platform.mtlsTLSConfig(),
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	serverErrors := make(chan error, 3)
+	for _, server := range []*http.Server{apiServer, mtlsServer} {
+		go func(s *http.Server) {
+			if err := s.ListenAndServeTLS("", ""); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				serverErrors <- fmt.Errorf("%s: %w", s.Addr, err)
+			}
+		}(server)
+	}
+	mqttAddress := net.JoinHostPort(g.ListenAddress, strconv.Itoa(g.MqttPort))
+	var mqttListener net.Listener
+	if g.MqttPort > 0 {
+		if mqttListener, err = tls.Listen("tcp", mqttAddress, platform.mtlsTLSConfig()); err != nil {
+			slog.Error("Error while listening for MQTT. Exiting now.", "error", err, "address", mqttAddress)
+			os.Exit(exitCodeGeneralProcessingError)
+		}
+		go func() {
+			if err := platform.serveMQTT(mqttListener); err != nil {
+				serverErrors <- fmt.Errorf("%s: %w", mqttAddress, err)
+			}
+		}()
+	}
+	slog.Info(fmt.Sprintf("Mock platform is listening. Use --cumulocity-host 'https://%s' (press Ctrl+C to stop)", apiServer.Addr),
+		"tenantId", g.TenantId, "mtlsAddress", mtlsServer.Addr, "mqttAddress", mqttAddress)
+
+	select {
+	case err := <-serverErrors:
+		slog.Error("Error while serving mock platform. Exiting now.", "error", err)
+		os.Exit(exitCodeGeneralProcessingError)
+	case <-ctx.Done():
+	}
+
+	slog.Info("Shutting down mock platform")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	apiServer.Shutdown(shutdownCtx)
+	mtlsServer.Shutdown(shutdownCtx)
+	if mqttListener != nil {
+		mqttListener.Close()
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+)
+
+// Signs the SHA-256 digest of a message (PKCS#1 v1.5 for RSA, ASN.1 for ECDSA keys) and returns the base64 encoded signature
+func signSHA256(key crypto.Signer, message []byte) (string, error) {
+	digest := sha256.Sum256(message)
+	signature, err := key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(signature), nil
+}
+
+// Verifies a base64 encoded signature created by signSHA256
+func verifySHA256Signature(publicKey crypto.PublicKey, message []byte, signature string) error {
+	raw, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return fmt.Errorf("signature is not base64 encoded: %w", err)
+	}
+	digest := sha256.Sum256(message)
+	switch key := publicKey.(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], raw)
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(key, digest[:], raw) {
+			return errors.New("signature does not match")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported public key type %T", publicKey)
+}
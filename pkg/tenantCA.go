@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/reubenmiller/go-c8y/pkg/c8y"
+	"github.com/reubenmiller/go-c8y/pkg/certutil"
+)
+
+// Command group managing the certificate authority (CA) of the tenant. The connection options are shared by all sub commands.
+type CmdGroupTenantCA struct {
+	C8yHost     string `long:"cumulocity-host" description:"Provide platform endpoint, e.g. 'https://iot.eu-latest.cumulocity.com'" required:"true"`
+	C8yTenantId string `long:"cumulocity-tenant-id" description:"Provide platform tenand id, e.g. 't4009123'. Optional (resolved from host when missing)" required:"false"`
+	C8yUser     string `long:"cumulocity-user" description:"Provide your platform user, e.g. 'john.doe@example.org'" required:"true"`
+	C8yPassword string `long:"cumulocity-password" description:"Provide your platform users password, e.g. 'aVerySecretPass1337'" required:"true"`
+
+	Create   CmdTenantCACreate   `command:"create" description:"Create the tenant CA if it is missing"`
+	Show     CmdTenantCAShow     `command:"show" description:"Show subject, validity and fingerprint of the tenant CA"`
+	Download CmdTenantCADownload `command:"download" description:"Download the tenant CA certificate (PEM)"`
+	Renew    CmdTenantCARenew    `command:"renew" description:"Renew the tenant CA certificate when it is nearing expiry"`
+}
+
+type CmdTenantCACreate struct {
+	AutoRegistration bool `long:"auto-registration" description:"Enable auto registration of devices with certificates issued by the tenant CA"`
+}
+
+type CmdTenantCAShow struct{}
+
+type CmdTenantCADownload struct {
+	Output string `long:"output" description:"File path the CA certificate is written to" default:"c8y-tenant-ca.pem"`
+}
+
+type CmdTenantCARenew struct {
+	RenewBefore time.Duration `long:"renew-before" description:"Renew the CA certificate if it expires within this duration" default:"720h"`
+	Force       bool          `long:"force" description:"Renew the CA certificate regardless of its expiry"`
+}
+
+var tenantCACmdName = "tenantCA"
+var tenantCACmdGroup CmdGroupTenantCA
+
+// Required to manage trusted certificates (including the tenant CA)
+const trustedCertificatesAdminRole = "ROLE_TENANT_MANAGEMENT_ADMIN"
+
+// client logs the start of a sub command and returns a client for the tenant of the shared connection options
+func (g *CmdGroupTenantCA) client(subCommand string, arguments string) *c8y.Client {
+	slog.Info(fmt.Sprintf("Started %s %s with arguments: C8yHost=%s C8yTenantId=%s C8yUser=%s C8yPassword=%s%s",
+		tenantCACmdName, subCommand, g.C8yHost, g.C8yTenantId, g.C8yUser, "{obfuscated}", arguments))
+	tenantID := resolveTenantIDOrExit(g.C8yHost, g.C8yTenantId, g.C8yUser, g.C8yPassword)
+	return newC8yClient(g.C8yHost, tenantID, g.C8yUser, g.C8yPassword)
+}
+
+func (g *CmdTenantCACreate) Execute(args []string) error {
+	client := tenantCACmdGroup.client("create", fmt.Sprintf(" AutoRegistration=%t", g.AutoRegistration))
+
+	ca, e := getTenantCA(client)
+	if e != nil {
+		slog.Error("Error while retrieving tenant CA. Exiting now.", "error", e)
+		os.Exit(exitCodeGeneralProcessingError)
+	}
+	if ca != nil {
+		slog.Info("Tenant CA exists already", "fingerprint", ca.Fingerprint)
+		printTenantCA(ca)
+		return nil
+	}
+
+	slog.Info("Testing user for having the required permissions")
+	if e := checkForRequiredRoles(client, trustedCertificatesAdminRole); e != nil {
+		slog.Error("Error while checking User permissions. Exiting now.", "error", e)
+		os.Exit(exitCodePrerequisitesNotFulfilled)
+	}
+	ca, e = client.CertificateAuthority.Create(context.TODO(), c8y.CertificateAuthorityOptions{
+		Status:           c8y.CertificateStatusEnabled,
+		AutoRegistration: g.AutoRegistration,
+	})
+	if e != nil {
+		slog.Error("Error while creating tenant CA. Is the feature '"+certificateAuthorityFeature+"' active? Exiting now.", "error", e)
+		os.Exit(exitCodeGeneralProcessingError)
+	}
+	slog.Info("Created tenant CA", "fingerprint", ca.Fingerprint)
+	printTenantCA(ca)
+	return nil
+}
+
+func (g *CmdTenantCAShow) Execute(args []string) error {
+	client := tenantCACmdGroup.client("show", "")
+	printTenantCA(getTenantCAOrExit(client))
+	return nil
+}
+
+func (g *CmdTenantCADownload) Execute(args []string) error {
+	client := tenantCACmdGroup.client("download", " Output="+g.Output)
+
+	ca := getTenantCAOrExit(client)
+	cert, e := parseTrustedCertificate(ca)
+	if e != nil {
+		slog.Error("Error while parsing tenant CA certificate. Exiting now.", "error", e, "fingerprint", ca.Fingerprint)
+		os.Exit(exitCodeGeneralProcessingError)
+	}
+	if e := writeToFile(string(certutil.MarshalCertificateToPEM(cert.Raw)), g.Output); e != nil {
+		slog.Error("Error while writing tenant CA certificate. Exiting now.", "error", e, "fileName", g.Output)
+		os.Exit(exitCodeGeneralProcessingError)
+	}
+	slog.Info("Placed tenant CA certificate", "fileName", g.Output, "fingerprint", ca.Fingerprint)
+	return nil
+}
+
+func (g *CmdTenantCARenew) Execute(args []string) error {
+	client := tenantCACmdGroup.client("renew", fmt.Sprintf(" RenewBefore=%s Force=%t", g.RenewBefore, g.Force))
+
+	ca := getTenantCAOrExit(client)
+	notAfter, e := time.Parse(time.RFC3339, ca.NotAfter)
+	if e != nil {
+		slog.Error("Error while parsing expiry of tenant CA. Exiting now.", "error", e, "notAfter", ca.NotAfter)
+		os.Exit(exitCodeGeneralProcessingError)
+	}
+	remaining := time.Until(notAfter)
+	if !g.Force && remaining > g.RenewBefore {
+		slog.Info("Tenant CA is not nearing expiry. Skipping renewal.", "notAfter", ca.NotAfter,
+			"expiresIn", remaining.Round(time.Hour), "renewBefore", g.RenewBefore)
+		return nil
+	}
+
+	slog.Info("Testing user for having the required permissions")
+	if e := checkForRequiredRoles(client, trustedCertificatesAdminRole); e != nil {
+		slog.Error("Error while checking User permissions. Exiting now.", "error", e)
+		os.Exit(exitCodePrerequisitesNotFulfilled)
+	}
+	slog.Info("Renewing tenant CA", "fingerprint", ca.Fingerprint, "notAfter", ca.NotAfter, "expiresIn", remaining.Round(time.Hour))
+	renewed, e := renewTenantCA(client, ca)
+	if e != nil {
+		slog.Error("Error while renewing tenant CA. Exiting now.", "error", e, "fingerprint", ca.Fingerprint)
+		os.Exit(exitCodeGeneralProcessingError)
+	}
+	slog.Info("Renewed tenant CA. Devices and systems trusting the previous CA certificate need the renewed one (see 'download'). Device certificates issued by the previous CA are not trusted anymore.",
+		"previousFingerprint", ca.Fingerprint, "fingerprint", renewed.Fingerprint)
+	printTenantCA(renewed)
+	return nil
+}
+
+// Returns the CA of the tenant, or nil if the tenant has none
+func getTenantCA(client *c8y.Client) (*c8y.Certificate, error) {
+	ca, err := client.CertificateAuthority.Get(context.TODO())
+	if errors.Is(err, c8y.ErrNotFound) {
+		return nil, nil
+	}
+	return ca, err
+}
+
+func getTenantCAOrExit(client *c8y.Client) *c8y.Certificate {
+	ca, err := getTenantCA(client)
+	if err != nil {
+		slog.Error("Error while retrieving tenant CA. Exiting now.", "error", err)
+		os.Exit(exitCodeGeneralProcessingError)
+	}
+	if ca == nil {
+		slog.Error("Tenant has no CA. Create it with '" + tenantCACmdName + " create'. Exiting now.")
+		os.Exit(exitCodePrerequisitesNotFulfilled)
+	}
+	return ca
+}
+
+// Renews the CA certificate of the tenant and returns the renewed one. The platform API has no renewal of the tenant
+// CA, so it is re-created with the documented endpoints: the current CA is deleted as trusted certificate
+// (DELETE /tenant/tenants/{tenantId}/trusted-certificates/{fingerprint}) and a new one is created
+// (POST /certificate-authority), keeping status and auto registration.
+func renewTenantCA(client *c8y.Client, ca *c8y.Certificate) (*c8y.Certificate, error) {
+	if _, err := client.DeviceCertificate.Delete(context.TODO(), client.TenantName, ca.Fingerprint); err != nil {
+		return nil, fmt.Errorf("deleting the current tenant CA failed: %w", err)
+	}
+	renewed, err := client.CertificateAuthority.Create(context.TODO(), c8y.CertificateAuthorityOptions{
+		Status:           ca.Status,
+		AutoRegistration: ca.IsAutoRegistrationEnabled(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("the current tenant CA was deleted, but creating the new one failed (create it with '%s create'): %w", tenantCACmdName, err)
+	}
+	return renewed, nil
+}
+
+// Parses the certificate of a trusted certificate representation (base64 encoded DER, or PEM)
+func parseTrustedCertificate(trusted *c8y.Certificate) (*x509.Certificate, error) {
+	if strings.Contains(trusted.CertInPemFormat, "-----BEGIN") {
+		return certutil.ParseCertificatePEM([]byte(trusted.CertInPemFormat))
+	}
+	der, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(trusted.CertInPemFormat), ""))
+	if err != nil {
+		return nil, fmt.Errorf("certificate is not base64 encoded: %w", err)
+	}
+	return x509.ParseCertificate(der)
+}
+
+func printTenantCA(ca *c8y.Certificate) {
+	expiry := ca.NotAfter
+	if notAfter, err := time.Parse(time.RFC3339, ca.NotAfter); err == nil {
+		if remaining := time.Until(notAfter); remaining > 0 {
+			expiry = fmt.Sprintf("%s (expires in %d days)", ca.NotAfter, int(remaining.Hours()/24))
+		} else {
+			expiry = ca.NotAfter + " (expired)"
+		}
+	}
+	fmt.Printf("%-20s %s\n", "Name:", ca.Name)
+	fmt.Printf("%-20s %s\n", "Subject:", ca.Subject)
+	fmt.Printf("%-20s %s\n", "Issuer:", ca.Issuer)
+	fmt.Printf("%-20s %s\n", "Serial number:", ca.SerialNumber)
+	fmt.Printf("%-20s %s\n", "Fingerprint:", ca.Fingerprint)
+	fmt.Printf("%-20s %s\n", "Algorithm:", ca.AlgorithmName)
+	fmt.Printf("%-20s %s\n", "Valid from:", ca.NotBefore)
+	fmt.Printf("%-20s %s\n", "Valid until:", expiry)
+	fmt.Printf("%-20s %s\n", "Status:", ca.Status)
+	fmt.Printf("%-20s %t\n", "Auto registration:", ca.IsAutoRegistrationEnabled())
+}
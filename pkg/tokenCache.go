@@ -0,0 +1,147 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Local cache of device access tokens, one file per host and certificate fingerprint. Files are only readable
+// by the owner as they contain valid credentials.
+
+type tokenCache struct {
+	dir string
+}
+
+type cachedToken struct {
+	Host        string    `json:"host"`
+	Fingerprint string    `json:"fingerprint"`
+	AccessToken string    `json:"accessToken"`
+	ExpiresAt   time.Time `json:"expiresAt"`
+}
+
+// defaultTokenCacheDir returns the directory below the user cache directory (e.g. ~/.cache on Linux)
+func defaultTokenCacheDir() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "c8y-certificate-cli", "tokens"), nil
+}
+
+// newTokenCacheOrExit returns the cache in dir (user cache directory when empty) or nil when caching is disabled
+func newTokenCacheOrExit(enabled bool, dir string) *tokenCache {
+	if !enabled {
+		return nil
+	}
+	if len(dir) == 0 {
+		var err error
+		if dir, err = defaultTokenCacheDir(); err != nil {
+			slog.Error("Error while resolving token cache directory. Use --cache-dir. Exiting now.", "error", err)
+			os.Exit(exitCodePrerequisitesNotFulfilled)
+		}
+	}
+	return &tokenCache{dir: dir}
+}
+
+func (c *tokenCache) fileName(host string, fingerprint string) string {
+	sum := sha256.Sum256([]byte(host + "|" + fingerprint))
+	return filepath.Join(c.dir, "token-"+hex.EncodeToString(sum[:8])+".json")
+}
+
+// load returns the cached token when it is valid for at least minValidity, otherwise nil
+func (c *tokenCache) load(host string, fingerprint string, minValidity time.Duration) *cachedToken {
+	content, err := os.ReadFile(c.fileName(host, fingerprint))
+	if err != nil {
+		return nil
+	}
+	token := &cachedToken{}
+	if err := json.Unmarshal(content, token); err != nil {
+		return nil
+	}
+	// the file name is a hash, so host and fingerprint are compared to rule out collisions
+	if token.Host != host || token.Fingerprint != fingerprint || time.Until(token.ExpiresAt) < minValidity {
+		return nil
+	}
+	return token
+}
+
+func (c *tokenCache) store(token *cachedToken) error {
+	if err := os.MkdirAll(c.dir, 0700); err != nil {
+		return err
+	}
+	content, err := json.Marshal(token)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomically(content, c.fileName(token.Host, token.Fingerprint), 0600)
+}
+
+// obtainAccessToken returns a token of the cache (when given and valid for at least refreshBefore) or requests a new
+// one and stores it in the cache. The token is only decoded for the cache, so tokens which aren't JWTs (e.g. redacted
+// ones of a replayed cassette) work without cache.
+func obtainAccessToken(host string, clientCert *tls.Certificate, cache *tokenCache, refreshBefore time.Duration) (*cachedToken, bool, error) {
+	host = strings.TrimSuffix(host, "/")
+	fingerprint := certificateFingerprint(clientCert.Leaf)
+	if cache != nil {
+		if token := cache.load(host, fingerprint, refreshBefore); token != nil {
+			return token, true, nil
+		}
+	}
+	accessToken, err := requestAccessToken(newC8yClient(host, "", "", ""), clientCert)
+	if err != nil {
+		return nil, false, err
+	}
+	token := &cachedToken{Host: host, Fingerprint: fingerprint, AccessToken: accessToken.AccessToken}
+	if cache == nil {
+		return token, false, nil
+	}
+	// the expiry is only needed for caching, a token without (readable) expiry is returned but not cached
+	expiresAt, err := accessTokenExpiry(token.AccessToken)
+	if err != nil {
+		slog.Warn("Access token is not cached, its expiry time is unknown", "error", err)
+		return token, false, nil
+	}
+	token.ExpiresAt = expiresAt
+	if err := cache.store(token); err != nil {
+		return nil, false, err
+	}
+	return token, false, nil
+}
+
+// expiresAt returns the expiry time of the token, decoded from the token when it doesn't come from the cache.
+// Returns false if the expiry time is unknown.
+func (t *cachedToken) expiresAt() (time.Time, bool) {
+	if !t.ExpiresAt.IsZero() {
+		return t.ExpiresAt, true
+	}
+	expiresAt, err := accessTokenExpiry(t.AccessToken)
+	return expiresAt, err == nil
+}
+
+// writeFileAtomically writes to a temporary file first and renames it, so readers never see partial content
+func writeFileAtomically(content []byte, fileName string, perm os.FileMode) error {
+	f, err := os.CreateTemp(filepath.Dir(fileName), "."+filepath.Base(fileName)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(content); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(perm); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), fileName)
+}
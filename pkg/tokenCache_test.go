@@ -0,0 +1,123 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/reubenmiller/go-c8y/pkg/c8y"
+)
+
+func TestObtainAccessToken(t *testing.T) {
+	signed := func(claims jwt.MapClaims) string {
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte("secret"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	valid := signed(jwt.MapClaims{"ten": "t12345", "exp": time.Now().Add(time.Hour).Unix()})
+	expiringSoon := signed(jwt.MapClaims{"ten": "t12345", "exp": time.Now().Add(time.Minute).Unix()})
+	withoutExpiry := signed(jwt.MapClaims{"ten": "t12345"})
+
+	tests := []struct {
+		name          string
+		accessToken   string
+		cache         bool
+		wantFromCache []bool
+		wantRequests  int32
+		wantCached    bool
+	}{
+		{"cached token is reused", valid, true, []bool{false, true, true}, 1, true},
+		{"token expiring soon is requested again", expiringSoon, true, []bool{false, false}, 2, true},
+		{"without cache", valid, false, []bool{false, false}, 2, false},
+		{"token without expiry is not cached", withoutExpiry, true, []bool{false, false}, 2, false},
+		{"token which isn't a JWT is not cached", redactedValue, true, []bool{false, false}, 2, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			platform := startTestPlatform(t)
+			_, _, clientCert := platform.writeDeviceCertificate(t, t.TempDir(), "token-device")
+			var requests atomic.Int32
+			server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests.Add(1)
+				writeMockJSON(w, http.StatusOK, c8y.AccessToken{AccessToken: tt.accessToken})
+			}))
+			server.TLS = platform.mtlsTLSConfig()
+			server.StartTLS()
+			t.Cleanup(server.Close)
+			routeAccessTokenEndpoint(t, server.Listener.Addr().String())
+
+			var cache *tokenCache
+			cacheDir := filepath.Join(t.TempDir(), "tokens")
+			if tt.cache {
+				cache = &tokenCache{dir: cacheDir}
+			}
+			for i, wantFromCache := range tt.wantFromCache {
+				token, fromCache, err := obtainAccessToken(platform.host, &clientCert, cache, 5*time.Minute)
+				if err != nil {
+					t.Fatalf("obtainAccessToken() error = %v", err)
+				}
+				if token.AccessToken != tt.accessToken {
+					t.Errorf("call %d: access token = %q, want %q", i+1, token.AccessToken, tt.accessToken)
+				}
+				if fromCache != wantFromCache {
+					t.Errorf("call %d: fromCache = %t, want %t", i+1, fromCache, wantFromCache)
+				}
+			}
+			if got := requests.Load(); got != tt.wantRequests {
+				t.Errorf("access token requests = %d, want %d", got, tt.wantRequests)
+			}
+
+			files, _ := filepath.Glob(filepath.Join(cacheDir, "token-*.json"))
+			if cached := len(files) > 0; cached != tt.wantCached {
+				t.Fatalf("token cached = %t, want %t", cached, tt.wantCached)
+			}
+			for _, file := range files {
+				info, err := os.Stat(file)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if perm := info.Mode().Perm(); perm != 0600 {
+					t.Errorf("cache file permissions = %o, want 600", perm)
+				}
+			}
+		})
+	}
+}
+
+func TestTokenCacheLoad(t *testing.T) {
+	stored := &cachedToken{Host: "https://example.org", Fingerprint: "ab12", AccessToken: "token", ExpiresAt: time.Now().Add(time.Hour)}
+	tests := []struct {
+		name        string
+		host        string
+		fingerprint string
+		minValidity time.Duration
+		wantToken   bool
+	}{
+		{"valid token", "https://example.org", "ab12", 5 * time.Minute, true},
+		{"token expiring within minimum validity", "https://example.org", "ab12", 2 * time.Hour, false},
+		{"other certificate", "https://example.org", "cd34", 5 * time.Minute, false},
+		{"other host", "https://other.example.org", "ab12", 5 * time.Minute, false},
+	}
+	cache := &tokenCache{dir: t.TempDir()}
+	if err := cache.store(stored); err != nil {
+		t.Fatalf("store() error = %v", err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token := cache.load(tt.host, tt.fingerprint, tt.minValidity)
+			if (token != nil) != tt.wantToken {
+				t.Fatalf("load() = %v, want token %t", token, tt.wantToken)
+			}
+			if token != nil && token.AccessToken != stored.AccessToken {
+				t.Errorf("load() access token = %q, want %q", token.AccessToken, stored.AccessToken)
+			}
+		})
+	}
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/reubenmiller/go-c8y/pkg/c8y"
+	"github.com/reubenmiller/go-c8y/pkg/certutil"
+)
+
+// Command group managing trusted certificates of the tenant, e.g. the CA of a corporate PKI issuing device certificates.
+// The connection options are shared by all sub commands.
+type CmdGroupTrustedCert struct {
+	C8yHost     string `long:"cumulocity-host" description:"Provide platform endpoint, e.g. 'https://iot.eu-latest.cumulocity.com'" required:"true"`
+	C8yTenantId string `long:"cumulocity-tenant-id" description:"Provide platform tenand id, e.g. 't4009123'. Optional (resolved from host when missing)" required:"false"`
+	C8yUser     string `long:"cumulocity-user" description:"Provide your platform user, e.g. 'john.doe@example.org'" required:"true"`
+	C8yPassword string `long:"cumulocity-password" description:"Provide your platform users password, e.g. 'aVerySecretPass1337'" required:"true"`
+
+	Upload CmdTrustedCertUpload `command:"upload" description:"Upload a CA certificate to the trusted certificates (and prove possession of its key)"`
+	Verify CmdTrustedCertVerify `command:"verify" description:"Prove possession of the private key of a trusted certificate"`
+	Update CmdTrustedCertUpdate `command:"update" description:"Enable/disable a trusted certificate or its auto registration"`
+	List   CmdTrustedCertList   `command:"list" description:"List the trusted certificates of the tenant"`
+	Delete CmdTrustedCertDelete `command:"delete" description:"Delete a trusted certificate"`
+}
+
+type CmdTrustedCertUpload struct {
+	CertificateFile  string `long:"certificate" description:"File path of the CA certificate (PEM)" required:"true"`
+	Name             string `long:"name" description:"Name of the trusted certificate. Default: common name of the certificate"`
+	Status           string `long:"status" description:"Status of the trusted certificate" choice:"ENABLED" choice:"DISABLED" default:"ENABLED"`
+	AutoRegistration bool   `long:"auto-registration" description:"Enable auto registration of devices with certificates issued by this CA"`
+	PrivateKeyFile   string `long:"private-key" description:"Private key of the CA certificate. If provided, the proof of possession is done right after the upload"`
+}
+
+type CmdTrustedCertVerify struct {
+	trustedCertSelector
+	PrivateKeyFile string `long:"private-key" description:"Private key of the trusted certificate, used to sign the verification code" required:"true"`
+}
+
+type CmdTrustedCertUpdate struct {
+	trustedCertSelector
+	Status           string `long:"status" description:"New status of the trusted certificate" choice:"ENABLED" choice:"DISABLED"`
+	AutoRegistration string `long:"auto-registration" description:"Enable or disable auto registration" choice:"enabled" choice:"disabled"`
+}
+
+type CmdTrustedCertList struct{}
+
+type CmdTrustedCertDelete struct {
+	trustedCertSelector
+}
+
+// Options selecting a trusted certificate by fingerprint or certificate file
+type trustedCertSelector struct {
+	Fingerprint     string `long:"fingerprint" description:"Fingerprint of the trusted certificate (see 'list')"`
+	CertificateFile string `long:"certificate" description:"File path of the trusted certificate (PEM), used to compute the fingerprint"`
+}
+
+var trustedCertCmdName = "trustedCert"
+var trustedCertCmdGroup CmdGroupTrustedCert
+
+// Trusted certificate including the proof of possession fields (not part of c8y.Certificate)
+type trustedCertificate struct {
+	c8y.Certificate
+	ProofOfPossessionValid                       *bool  `json:"proofOfPossessionValid,omitempty"`
+	ProofOfPossessionUnsignedVerificationCode    string `json:"proofOfPossessionUnsignedVerificationCode,omitempty"`
+	ProofOfPossessionVerificationCodeUsableUntil string `json:"proofOfPossessionVerificationCodeUsableUntil,omitempty"`
+}
+
+// client logs the start of a sub command and returns a client for the tenant of the shared connection options
+func (g *CmdGroupTrustedCert) client(subCommand string, arguments string) *c8y.Client {
+	slog.Info(fmt.Sprintf("Started %s %s with arguments: C8yHost=%s C8yTenantId=%s C8yUser=%s C8yPassword=%s%s",
+		trustedCertCmdName, subCommand, g.C8yHost, g.C8yTenantId, g.C8yUser, "{obfuscated}", arguments))
+	tenantID := resolveTenantIDOrExit(g.C8yHost, g.C8yTenantId, g.C8yUser, g.C8yPassword)
+	client := newC8yClient(g.C8yHost, tenantID, g.C8yUser, g.C8yPassword)
+	if subCommand != "list" {
+		slog.Info("Testing user for having the required permissions")
+		if e := checkForRequiredRoles(client, trustedCertificatesAdminRole); e != nil {
+			slog.Error("Error while checking User permissions. Exiting now.", "error", e)
+			os.Exit(exitCodePrerequisitesNotFulfilled)
+		}
+	}
+	return client
+}
+
+func (g *CmdTrustedCertUpload) Execute(args []string) error {
+	client := trustedCertCmdGroup.client("upload", fmt.Sprintf(" CertificateFile=%s Name=%s Status=%s AutoRegistration=%t PrivateKeyFile=%s",
+		g.CertificateFile, g.Name, g.Status, g.AutoRegistration, g.PrivateKeyFile))
+
+	cert, e := readCertificateFile(g.CertificateFile)
+	if e != nil {
+		slog.Error("Error while reading certificate. Exiting now.", "error", e, "fileName", g.CertificateFile)
+		os.Exit(exitCodePrerequisitesNotFulfilled)
+	}
+	if !cert.IsCA {
+		slog.Warn("Certificate is not a CA certificate. Only the certificate itself can be used by devices.", "subject", cert.Subject.String())
+	}
+	var key crypto.Signer
+	if len(g.PrivateKeyFile) > 0 {
+		if key, e = readSigningKey(g.PrivateKeyFile, cert); e != nil {
+			slog.Error("Error while reading private key. Exiting now.", "error", e, "fileName", g.PrivateKeyFile)
+			os.Exit(exitCodePrerequisitesNotFulfilled)
+		}
+	}
+
+	fingerprint := certificateFingerprint(cert)
+	name := valueOrDefault(g.Name, cert.Subject.CommonName)
+	autoRegistration := g.AutoRegistration
+	_, resp, e := client.DeviceCertificate.Create(context.TODO(), client.TenantName, c8y.Certificate{
+		Name:                    name,
+		CertInPemFormat:         base64.StdEncoding.EncodeToString(cert.Raw),
+		Status:                  g.Status,
+		AutoRegistrationEnabled: &autoRegistration,
+	})
+	switch {
+	case responseStatusCode(resp) == http.StatusConflict:
+		slog.Info("Certificate is a trusted certificate already", "fingerprint", fingerprint)
+		if e := updateExistingTrustedCertificate(client, fingerprint, g.Status, autoRegistration); e != nil {
+			slog.Error("Error while updating existing trusted certificate. Exiting now.", "error", e, "fingerprint", fingerprint)
+			os.Exit(exitCodeGeneralProcessingError)
+		}
+	case e != nil:
+		slog.Error("Error while uploading trusted certificate. Exiting now.", "error", e, "fingerprint", fingerprint)
+		os.Exit(exitCodeGeneralProcessingError)
+	default:
+		slog.Info("Uploaded trusted certificate", "name", name, "fingerprint", fingerprint, "status", g.Status, "autoRegistration", g.AutoRegistration)
+	}
+
+	if key == nil {
+		slog.Info("No private key provided. Prove possession of the key with '" + trustedCertCmdName + " verify' before devices use the certificate.")
+		return nil
+	}
+	if e := proveTrustedCertificatePossession(client, fingerprint, key); e != nil {
+		slog.Error("Error while proving possession of the private key. Exiting now.", "error", e, "fingerprint", fingerprint)
+		os.Exit(exitCodeGeneralProcessingError)
+	}
+	slog.Info("Proof of possession succeeded", "fingerprint", fingerprint)
+	return nil
+}
+
+// updateExistingTrustedCertificate applies the requested status and auto registration to a trusted certificate uploaded before
+func updateExistingTrustedCertificate(client *c8y.Client, fingerprint string, status string, autoRegistration bool) error {
+	existing, _, err := client.DeviceCertificate.GetCertificate(context.TODO(), client.TenantName, fingerprint)
+	if err != nil {
+		return err
+	}
+	if existing.Status == status && existing.IsAutoRegistrationEnabled() == autoRegistration {
+		slog.Info("Trusted certificate has the requested settings already", "fingerprint", fingerprint, "status", status, "autoRegistration", autoRegistration)
+		return nil
+	}
+	update := c8y.Certificate{Status: status}
+	update.WithAutoRegistration(autoRegistration)
+	updated, _, err := client.DeviceCertificate.Update(context.TODO(), client.TenantName, fingerprint, update)
+	if err != nil {
+		return err
+	}
+	slog.Info("Updated existing trusted certificate", "fingerprint", fingerprint,
+		"status", fmt.Sprintf("%s -> %s", existing.Status, updated.Status),
+		"autoRegistration", fmt.Sprintf("%t -> %t", existing.IsAutoRegistrationEnabled(), updated.IsAutoRegistrationEnabled()))
+	return nil
+}
+
+func (g *CmdTrustedCertVerify) Execute(args []string) error {
+	client := trustedCertCmdGroup.client("verify", g.arguments()+" PrivateKeyFile="+g.PrivateKeyFile)
+
+	fingerprint, cert := g.resolveOrExit()
+	key, e := readSigningKey(g.PrivateKeyFile, cert)
+	if e != nil {
+		slog.Error("Error while reading private key. Exiting now.", "error", e, "fileName", g.PrivateKeyFile)
+		os.Exit(exitCodePrerequisitesNotFulfilled)
+	}
+	if e := proveTrustedCertificatePossession(client, fingerprint, key); e != nil {
+		slog.Error("Error while proving possession of the private key. Exiting now.", "error", e, "fingerprint", fingerprint)
+		os.Exit(exitCodeGeneralProcessingError)
+	}
+	slog.Info("Proof of possession succeeded", "fingerprint", fingerprint)
+	return nil
+}
+
+func (g *CmdTrustedCertUpdate) Execute(args []string) error {
+	client := trustedCertCmdGroup.client("update", g.arguments()+fmt.Sprintf(" Status=%s AutoRegistration=%s", g.Status, g.AutoRegistration))
+
+	fingerprint, _ := g.resolveOrExit()
+	if len(g.Status) == 0 && len(g.AutoRegistration) == 0 {
+		slog.Error("Nothing to update. Provide --status and/or --auto-registration. Exiting now.")
+		os.Exit(exitCodePrerequisitesNotFulfilled)
+	}
+	update := c8y.Certificate{Status: g.Status}
+	if len(g.AutoRegistration) > 0 {
+		update.WithAutoRegistration(g.AutoRegistration == "enabled")
+	}
+	updated, resp, e := client.DeviceCertificate.Update(context.TODO(), client.TenantName, fingerprint, update)
+	if responseStatusCode(resp) == http.StatusNotFound {
+		slog.Error("Trusted certificate not found. Exiting now.", "fingerprint", fingerprint)
+		os.Exit(exitCodePrerequisitesNotFulfilled)
+	}
+	if e != nil {
+		slog.Error("Error while updating trusted certificate. Exiting now.", "error", e, "fingerprint", fingerprint)
+		os.Exit(exitCodeGeneralProcessingError)
+	}
+	slog.Info("Updated trusted certificate", "fingerprint", fingerprint, "status", updated.Status, "autoRegistration", updated.IsAutoRegistrationEnabled())
+	return nil
+}
+
+func (g *CmdTrustedCertList) Execute(args []string) error {
+	client := trustedCertCmdGroup.client("list", "")
+
+	certificates, e := getTrustedCertificates(client)
+	if e != nil {
+		slog.Error("Error while retrieving trusted certificates. Exiting now.", "error", e)
+		os.Exit(exitCodeGeneralProcessingError)
+	}
+	fmt.Printf("%-42s %-32s %-10s %-10s %-12s %s\n", "FINGERPRINT", "NAME", "STATUS", "AUTO REG", "POSSESSION", "NOT AFTER")
+	for _, c := range certificates {
+		possession := "unverified"
+		if c.ProofOfPossessionValid == nil {
+			possession = registrationStateNotAvailable
+		} else if *c.ProofOfPossessionValid {
+			possession = "verified"
+		}
+		name := c.Name
+		if c.TenantCertificateAuthority {
+			name += " (tenant CA)"
+		}
+		fmt.Printf("%-42s %-32s %-10s %-10t %-12s %s\n", c.Fingerprint, name, c.Status, c.IsAutoRegistrationEnabled(), possession, c.NotAfter)
+	}
+	return nil
+}
+
+func (g *CmdTrustedCertDelete) Execute(args []string) error {
+	client := trustedCertCmdGroup.client("delete", g.arguments())
+
+	fingerprint, _ := g.resolveOrExit()
+	resp, e := client.DeviceCertificate.Delete(context.TODO(), client.TenantName, fingerprint)
+	if responseStatusCode(resp) == http.StatusNotFound {
+		slog.Info("Trusted certificate does not exist. Nothing to delete.", "fingerprint", fingerprint)
+		return nil
+	}
+	if e != nil {
+		slog.Error("Error while deleting trusted certificate. Exiting now.", "error", e, "fingerprint", fingerprint)
+		os.Exit(exitCodeGeneralProcessingError)
+	}
+	slog.Info("Deleted trusted certificate. Devices with certificates issued by it can't request access tokens anymore.", "fingerprint", fingerprint)
+	return nil
+}
+
+func (s *trustedCertSelector) arguments() string {
+	return fmt.Sprintf(" Fingerprint=%s CertificateFile=%s", s.Fingerprint, s.CertificateFile)
+}
+
+// resolveOrExit returns the fingerprint of the selected trusted certificate, and the certificate if selected by file
+func (s *trustedCertSelector) resolveOrExit() (string, *x509.Certificate) {
+	if len(s.CertificateFile) == 0 {
+		if len(s.Fingerprint) == 0 {
+			slog.Error("Provide the trusted certificate with --fingerprint or --certificate. Exiting now.")
+			os.Exit(exitCodePrerequisitesNotFulfilled)
+		}
+		return strings.ToLower(s.Fingerprint), nil
+	}
+	cert, err := readCertificateFile(s.CertificateFile)
+	if err != nil {
+		slog.Error("Error while reading certificate. Exiting now.", "error", err, "fileName", s.CertificateFile)
+		os.Exit(exitCodePrerequisitesNotFulfilled)
+	}
+	fingerprint := certificateFingerprint(cert)
+	if len(s.Fingerprint) > 0 && !strings.EqualFold(s.Fingerprint, fingerprint) {
+		slog.Error("Fingerprint does not match the certificate. Exiting now.", "fingerprint", s.Fingerprint, "certificateFingerprint", fingerprint)
+		os.Exit(exitCodePrerequisitesNotFulfilled)
+	}
+	return fingerprint, cert
+}
+
+// Returns all trusted certificates of the tenant (including the proof of possession state)
+func getTrustedCertificates(client *c8y.Client) ([]trustedCertificate, error) {
+	collection := struct {
+		Certificates []trustedCertificate `json:"certificates"`
+	}{}
+	_, err := client.SendRequest(context.TODO(), c8y.RequestOptions{
+		Method:       http.MethodGet,
+		Path:         "tenant/tenants/" + client.TenantName + "/trusted-certificates",
+		Query:        &c8y.PaginationOptions{PageSize: 2000},
+		ResponseData: &collection,
+	})
+	return collection.Certificates, err
+}
+
+// Proves possession of the private key of a trusted certificate: the platform issues a verification code, which is signed
+// with the private key and sent back
+func proveTrustedCertificatePossession(client *c8y.Client, fingerprint string, key crypto.Signer) error {
+	path := "tenant/tenants/" + client.TenantName + "/trusted-certificates-pop/" + fingerprint
+	challenge := new(trustedCertificate)
+	if _, err := client.SendRequest(context.TODO(), c8y.RequestOptions{
+		Method:       http.MethodPost,
+		Path:         path + "/verification-code",
+		ResponseData: challenge,
+	}); err != nil {
+		return fmt.Errorf("error while requesting verification code: %w", err)
+	}
+	if len(challenge.ProofOfPossessionUnsignedVerificationCode) == 0 {
+		return errors.New("platform did not provide a verification code")
+	}
+	slog.Info("Received verification code", "fingerprint", fingerprint, "usableUntil", challenge.ProofOfPossessionVerificationCodeUsableUntil)
+
+	signedCode, err := signSHA256(key, []byte(challenge.ProofOfPossessionUnsignedVerificationCode))
+	if err != nil {
+		return fmt.Errorf("error while signing verification code: %w", err)
+	}
+	result := new(trustedCertificate)
+	if _, err := client.SendRequest(context.TODO(), c8y.RequestOptions{
+		Method:       http.MethodPost,
+		Path:         path + "/pop",
+		Body:         map[string]string{"proofOfPossessionSignedVerificationCode": signedCode},
+		ResponseData: result,
+	}); err != nil {
+		return fmt.Errorf("error while sending signed verification code: %w", err)
+	}
+	if result.ProofOfPossessionValid != nil && !*result.ProofOfPossessionValid {
+		return errors.New("platform rejected the signed verification code")
+	}
+	return nil
+}
+
+// Reads a private key for signing. If a certificate is given, the key must belong to it.
+func readSigningKey(fileName string, cert *x509.Certificate) (crypto.Signer, error) {
+	key, err := certutil.PrivateKeyFromFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+	if cert != nil {
+		if publicKey, ok := cert.PublicKey.(interface{ Equal(crypto.PublicKey) bool }); !ok || !publicKey.Equal(signer.Public()) {
+			return nil, errors.New("private key does not belong to the certificate")
+		}
+	}
+	return signer, nil
+}
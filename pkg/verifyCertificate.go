@@ -1,18 +1,26 @@
 package main
 
 import (
-	"context"
+	"bufio"
 	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"net"
+	"net/url"
 	"os"
-
-	"github.com/reubenmiller/go-c8y/pkg/c8y"
+	"strconv"
+	"time"
 )
 
 type CmdGroupVerifyCertificate struct {
-	C8yHost         string `long:"cumulocity-host" description:"Provide platform endpoint, e.g. 'https://iot.eu-latest.cumulocity.com'" required:"true"`
-	CertificateFile string `long:"certificate" description:"File path to your certificate" required:"true"`
-	PrivateKeyFile  string `long:"private-key" description:"File path to your private key" required:"true"`
+	C8yHost         string        `long:"cumulocity-host" description:"Provide platform endpoint, e.g. 'https://iot.eu-latest.cumulocity.com'" required:"true"`
+	CertificateFile string        `long:"certificate" description:"File path to your certificate" required:"true"`
+	PrivateKeyFile  string        `long:"private-key" description:"File path to your private key" required:"true"`
+	Mode            string        `long:"mode" description:"'http' requests an access token, 'mqtt' connects to the MQTT endpoint with the certificate" choice:"http" choice:"mqtt" default:"http"`
+	MqttPort        int           `long:"mqtt-port" description:"Port of the MQTT endpoint (mode 'mqtt')" default:"8883"`
+	Publish         string        `long:"publish" description:"Optional SmartREST message published after connecting (mode 'mqtt'), e.g. '400,c8y_MyEvent,\"Something was triggered\"'" required:"false"`
+	Topic           string        `long:"topic" description:"Topic the --publish message is sent to" default:"s/us"`
+	Timeout         time.Duration `long:"timeout" description:"Timeout for the MQTT connection (mode 'mqtt')" default:"10s"`
 }
 
 var verifyCertificateCmdName = "verifyCert"
@@ -34,15 +42,14 @@ func (g *CmdGroupVerifyCertificate) Execute(args []string) error {
 		errMessage := fmt.Sprintf("Error while processing certificate and private key. Error = %s.", err.Error())
 		exitWithErr(errMessage)
 	}
-	client := c8y.NewClient(nil, g.C8yHost, "", "", "", false)
-	_, tokenResp, err := client.DeviceEnrollment.RequestAccessToken(context.Background(), &clientCert, nil)
-	if err != nil {
-		errMessage := fmt.Sprintf("Error while requesting access token. Error = %s.", err.Error())
-		exitWithErr(errMessage)
+	if g.Mode == "mqtt" {
+		g.verifyMqtt(clientCert)
+		fmt.Println("Verification result: OK")
+		return nil
 	}
-	if tokenResp.Response.StatusCode != 200 {
-		errMessage := fmt.Sprintf("Unexpected response code while requesting first access token. Expected 200, received %d",
-			tokenResp.Response.StatusCode)
+	client := newC8yClient(g.C8yHost, "", "", "")
+	if _, err := requestAccessToken(client, &clientCert); err != nil {
+		errMessage := fmt.Sprintf("Error while requesting access token. Error = %s.", err.Error())
 		exitWithErr(errMessage)
 	}
 	fmt.Println("Verification result: OK")
@@ -50,6 +57,64 @@ func (g *CmdGroupVerifyCertificate) Execute(args []string) error {
 	return nil
 }
 
+// verifyMqtt connects via TLS to the MQTT endpoint of the platform and reports TLS handshake, MQTT CONNECT (with the
+// common name of the certificate as client id) and the optional publish separately. Exits on the first failing step.
+func (g *CmdGroupVerifyCertificate) verifyMqtt(clientCert tls.Certificate) {
+	hostURL, err := url.Parse(g.C8yHost)
+	if err != nil || len(hostURL.Hostname()) == 0 {
+		exitWithErr(fmt.Sprintf("Invalid Cumulocity host: %s", g.C8yHost))
+	}
+	address := net.JoinHostPort(hostURL.Hostname(), strconv.Itoa(g.MqttPort))
+	clientID := clientCert.Leaf.Subject.CommonName
+
+	// same as for HTTP, the server certificate is not verified (self signed certificates of Edge instances)
+	dialer := &net.Dialer{Timeout: g.Timeout}
+	conn, err := tls.DialWithDialer(dialer, "tcp", address, &tls.Config{
+		Certificates:       []tls.Certificate{clientCert},
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		fmt.Println("TLS handshake: NOT_OK")
+		exitWithErr(fmt.Sprintf("Error during TLS handshake with %s. Error = %s.", address, err.Error()))
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(g.Timeout))
+
+	// with TLS 1.3 a rejected client certificate is only reported by the server's answer to CONNECT, so the
+	// handshake result is printed once CONNECT is answered
+	reader := bufio.NewReader(conn)
+	err = mqttConnect(conn, reader, clientID, 60)
+	if isTLSAlert(err) {
+		fmt.Println("TLS handshake: NOT_OK")
+		exitWithErr(fmt.Sprintf("Client certificate rejected during TLS handshake with %s. Error = %s.", address, err.Error()))
+	}
+	state := conn.ConnectionState()
+	fmt.Printf("TLS handshake: OK (%s, %s, server certificate '%s')\n",
+		address, tls.VersionName(state.Version), serverCertificateSubject(state.PeerCertificates))
+	if err != nil {
+		fmt.Println("MQTT CONNECT: NOT_OK")
+		exitWithErr(fmt.Sprintf("Error during MQTT CONNECT with client id '%s'. Error = %s.", clientID, err.Error()))
+	}
+	fmt.Printf("MQTT CONNECT: OK (client id '%s')\n", clientID)
+
+	if len(g.Publish) == 0 {
+		fmt.Println("MQTT publish: SKIPPED (no --publish message given)")
+	} else if err := mqttPublish(conn, reader, g.Topic, g.Publish, 1); err != nil {
+		fmt.Println("MQTT publish: NOT_OK")
+		exitWithErr(fmt.Sprintf("Error while publishing to topic '%s'. Error = %s.", g.Topic, err.Error()))
+	} else {
+		fmt.Printf("MQTT publish: OK (topic '%s', message '%s')\n", g.Topic, g.Publish)
+	}
+	mqttDisconnect(conn)
+}
+
+func serverCertificateSubject(peerCertificates []*x509.Certificate) string {
+	if len(peerCertificates) == 0 {
+		return ""
+	}
+	return peerCertificates[0].Subject.String()
+}
+
 func exitWithErr(errorMessage string) {
 	fmt.Println("Verification result: NOT_OK")
 	fmt.Println("Reason: " + errorMessage)
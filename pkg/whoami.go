@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+)
+
+type CmdGroupWhoami struct {
+	C8yHost         string `long:"cumulocity-host" description:"Provide platform endpoint, e.g. 'https://iot.eu-latest.cumulocity.com'" required:"true"`
+	CertificateFile string `long:"certificate" description:"File path to your certificate" required:"true"`
+	PrivateKeyFile  string `long:"private-key" description:"File path to your private key" required:"true"`
+	IdentityType    string `long:"identity-type" description:"Type of the external ID the device managed object is looked up with first" default:"c8y_Serial"`
+}
+
+var whoamiCmdName = "whoami"
+var whoamiCmdGroup CmdGroupWhoami
+
+func (g *CmdGroupWhoami) Execute(args []string) error {
+	slog.Info(fmt.Sprintf("Started %s with arguments: C8yHost=%s CertFile=%s PrivKeyFile=%s IdentityType=%s",
+		whoamiCmdName, g.C8yHost, g.CertificateFile, g.PrivateKeyFile, g.IdentityType))
+
+	clientCert := readClientCertificateOrExit(g.CertificateFile, g.PrivateKeyFile)
+	cert := clientCert.Leaf
+	fmt.Printf("Certificate: %s (serial %s, issued by %s, expires %s)\n",
+		cert.Subject, serialToHex(cert.SerialNumber), cert.Issuer, cert.NotAfter.Format(time.RFC3339))
+
+	token, _, err := obtainAccessToken(g.C8yHost, &clientCert, nil, 0)
+	if err != nil {
+		slog.Error("Error while requesting access token. The certificate is not accepted by the platform. Exiting now.", "error", err)
+		os.Exit(exitCodeGeneralProcessingError)
+	}
+	fmt.Printf("Host: %s\n", token.Host)
+
+	// tenant and user are taken from the platform, the token might not be readable (e.g. redacted in a cassette)
+	client := newDeviceClient(g.C8yHost, token.AccessToken)
+	tenant, _, err := client.Tenant.GetCurrentTenant(context.TODO())
+	if err != nil {
+		slog.Error("Error while retrieving current tenant. Exiting now.", "error", err)
+		os.Exit(exitCodeGeneralProcessingError)
+	}
+	fmt.Printf("Tenant: %s\n", tenant.Name)
+	user, _, err := client.User.GetCurrentUser(context.TODO())
+	if err != nil {
+		slog.Error("Error while retrieving current user. Exiting now.", "error", err)
+		os.Exit(exitCodeGeneralProcessingError)
+	}
+	deviceUser := user.Username
+	if !user.Enabled {
+		deviceUser += " (disabled)"
+	}
+	fmt.Printf("Device user: %s\n", deviceUser)
+
+	mo, err := findDeviceManagedObject(client, g.IdentityType, cert.Subject.CommonName, user.Username)
+	if err != nil {
+		slog.Error("Error while looking up the device managed object. Exiting now.", "error", err)
+		os.Exit(exitCodeGeneralProcessingError)
+	}
+	if mo == nil {
+		fmt.Println("Managed object: not found (device did not create it yet or it was deleted)")
+		return nil
+	}
+	fmt.Printf("Managed object: %s (name '%s', type '%s')\n", mo.ID, mo.Name, mo.Type)
+
+	identities, err := getExternalIDs(client, mo.ID)
+	if err != nil {
+		slog.Error("Error while retrieving external ids. Exiting now.", "error", err, "managedObjectId", mo.ID)
+		os.Exit(exitCodeGeneralProcessingError)
+	}
+	externalIDs := make([]string, 0, len(identities))
+	for _, identity := range identities {
+		externalIDs = append(externalIDs, identity.Type+"="+identity.ExternalID)
+	}
+	fmt.Printf("External IDs: %s\n", strings.Join(externalIDs, ", "))
+	return nil
+}